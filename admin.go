@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// redactedConfigKeys are masked when the configuration is served
+var redactedConfigKeys = map[string]bool{
+	"credential": true,
+}
+
+// redacted : value masked, empty values stay empty to show they are unset
+func redacted(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// startAdminServer : serve the effective configuration on addr under GET
+// /config, and the plugin status under GET /healthz
+func (p *PluginContext) startAdminServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", p.configHandler)
+	mux.HandleFunc("/healthz", p.healthHandler)
+	p.AdminServer = &http.Server{Handler: mux}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.Warnf("admin server stopped: %v\n", err)
+		}
+	}(p.AdminServer)
+	p.Infof("admin server listening on %s\n", listener.Addr())
+	return nil
+}
+
+// configHandler : write the effective configuration as JSON, credentials masked
+func (p *PluginContext) configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.Lock()
+	config := p.effectiveConfig()
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsoniter.NewEncoder(w).Encode(config); err != nil {
+		p.Warnf("error writing admin config response: %v\n", err)
+	}
+}
+
+// effectiveConfig : the settings in effect once parsed and defaulted, keyed
+// in snake_case. Sizes are in bytes and durations are Go duration strings.
+func (p *PluginContext) effectiveConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	for key, value := range p.Config {
+		if redactedConfigKeys[key] {
+			value = redacted(value)
+		}
+		config[snakeCase(key)] = value
+	}
+
+	routes := make([]Route, len(p.Routes))
+	for i, route := range p.Routes {
+		routes[i] = Route{Match: route.Match, Bucket: route.Bucket, Prefix: route.Prefix, Credential: redacted(route.Credential)}
+	}
+	intervals := make(map[string]string, len(p.FlushIntervals))
+	for _, interval := range p.FlushIntervals {
+		intervals[interval.Match] = interval.Interval.String()
+	}
+	renames := make(map[string]string, len(p.RenameFields))
+	for _, rename := range p.RenameFields {
+		renames[rename.From] = rename.To
+	}
+	overflowPolicy := overflowBuffer
+	if p.Backpressure {
+		overflowPolicy = overflowBackpressure
+	}
+	suffix := p.KeyFormat.Suffix
+	if suffix == "" {
+		suffix = suffixUUID
+	}
+	granularity := p.KeyFormat.Granularity
+	if granularity == "" {
+		granularity = granularityDay
+	}
+
+	for key, value := range map[string]interface{}{
+		"output_buffer_size":         p.BufferSize,
+		"max_total_buffer_size":      p.MaxTotalBufferSize,
+		"adaptive_buffer":            p.AdaptiveBuffer,
+		"max_buffer_size":            p.MaxAdaptiveBufferSize,
+		"flush_record_count":         p.FlushRecordCount,
+		"max_record_size":            p.MaxRecordSize,
+		"record_separator":           string(p.recordSeparator()),
+		"overflow_policy":            overflowPolicy,
+		"max_retry_duration":         p.MaxRetryDuration.String(),
+		"backoff_strategy":           p.Backoff.Strategy,
+		"backoff_jitter":             p.Backoff.Jitter,
+		"blocking_retry":             p.BlockingRetry,
+		"max_inflight_retry_buffers": p.MaxInflightRetryBuffers,
+		"spill_dir":                  p.SpillDir,
+		"tag_routes":                 routes,
+		"tag_flush_intervals":        intervals,
+		"priority_map":               p.Priorities,
+
+		"date_format":           p.KeyFormat.dateFormat(),
+		"partition_granularity": granularity,
+		"object_suffix":         suffix,
+		"lexical_ordering":      p.KeyFormat.LexicalOrdering,
+		"writer_id":             p.KeyFormat.WriterID,
+		"dedupe_by_content":     p.KeyFormat.DedupeByContent,
+		"append_mode":           p.AppendMode,
+		"max_object_size":       p.MaxObjectSize,
+		"parallel_parts":        p.ParallelParts,
+		"storage_class":         p.StorageClass,
+		"storage_class_map":     p.StorageClasses,
+		"time_range_metadata":   p.TimeRangeMetadata,
+		"object_header_record":  p.ObjectHeaderRecord,
+
+		"add_metadata_fields":  p.MetadataFields != nil,
+		"include_fields":       p.FieldFilter.fields(true),
+		"exclude_fields":       p.FieldFilter.fields(false),
+		"rename_fields":        renames,
+		"merge_all_tags":       p.MergeAllTags,
+		"pre_compressed":       p.PreCompressed,
+		"skip_empty_records":   p.SkipEmptyRecords,
+		"collapse_consecutive": p.CollapseConsecutive,
+
+		"subpartition_by_event_time": p.SubpartitionByEventTime,
+		"partition_time_field":       p.PartitionTimeField,
+		"partition_time_format":      p.PartitionTimeFormat,
+
+		"compression_level":          p.CompressionLevel,
+		"size_based_compression":     p.SizeBasedCompression,
+		"compression_size_threshold": p.CompressionSizeThreshold,
+		"compress_buffer_size":       p.CompressBufferSize,
+		"min_compression_ratio":      p.MinCompressionRatio,
+
+		"read_after_write":       p.ReadAfterWrite,
+		"skip_if_exists":         p.SkipIfExists,
+		"dry_run":                p.DryRun,
+		"watchdog_timeout":       p.WatchdogTimeout.String(),
+		"watchdog_abort":         p.WatchdogAbort,
+		"max_concurrent_flushes": cap(p.WriteSlots),
+		"write_compaction_hint":  p.CompactionHints != nil,
+		"compaction_threshold":   p.CompactionThreshold,
+	} {
+		config[key] = value
+	}
+
+	if p.MetadataFields != nil {
+		config["metadata_tag_key"] = p.MetadataFields.TagKey
+		config["metadata_hostname_key"] = p.MetadataFields.HostnameKey
+		config["metadata_time_key"] = p.MetadataFields.TimeKey
+	}
+	if p.Logger != nil && p.Logger.Limiter != nil {
+		config["log_dedupe_window"] = p.Logger.Limiter.Window.String()
+	}
+	if p.Alerter != nil {
+		config["alert_webhook_url"] = redacted(p.Alerter.URL)
+		config["alert_failure_threshold"] = p.Alerter.Threshold
+		config["alert_interval"] = p.Alerter.Interval.String()
+	}
+	if client, ok := p.Client.(Client); ok {
+		config["content_type"] = client.ContentType
+		config["set_gzip_content_encoding"] = client.GzipContentEncoding
+		config["upload_chunk_size"] = client.ChunkSize
+		config["predefined_acl"] = client.PredefinedACL
+		config["project_id"] = client.ProjectID
+		config["max_single_object_bytes"] = client.MaxObjectBytes
+	}
+	return config
+}
+
+// snakeCase : key in snake_case, e.g. deadLetterPrefix as dead_letter_prefix
+func snakeCase(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// healthHandler : write the Status of the plugin as JSON
+func (p *PluginContext) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsoniter.NewEncoder(w).Encode(p.Status()); err != nil {
+		p.Warnf("error writing admin health response: %v\n", err)
+	}
+}
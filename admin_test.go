@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestConfigHandler(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{
+		"bucket":     "bucket",
+		"prefix":     "logs",
+		"credential": "/etc/gcs/key.json",
+	})
+	ctx.MaxRetryDuration = time.Hour
+	ctx.KeyFormat.Suffix = suffixSequence
+	ctx.Routes = []Route{{Match: "billing.*", Bucket: "billing", Credential: "/etc/gcs/billing.json"}}
+
+	rec := httptest.NewRecorder()
+	ctx.configHandler(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	var config map[string]interface{}
+	if err := jsoniter.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["bucket"] != "bucket" {
+		t.Errorf("bucket = %v, want %v", config["bucket"], "bucket")
+	}
+	if config["prefix"] != "logs" {
+		t.Errorf("prefix = %v, want %v", config["prefix"], "logs")
+	}
+	if config["credential"] != "REDACTED" {
+		t.Errorf("credential = %v, want %v", config["credential"], "REDACTED")
+	}
+	if strings.Contains(rec.Body.String(), ".json") {
+		t.Errorf("response %s leaks a credential path", rec.Body.String())
+	}
+	// parsed settings are served alongside the raw ones
+	for key, want := range map[string]interface{}{
+		"output_buffer_size": float64(1024 * 1024),
+		"object_suffix":      suffixSequence,
+		"max_retry_duration": "1h0m0s",
+	} {
+		if config[key] != want {
+			t.Errorf("%s = %v, want %v", key, config[key], want)
+		}
+	}
+	routes, _ := config["tag_routes"].([]interface{})
+	if len(routes) != 1 || routes[0].(map[string]interface{})["credential"] != "REDACTED" {
+		t.Errorf("tag_routes = %v, want the route credential masked", config["tag_routes"])
+	}
+
+	rec = httptest.NewRecorder()
+	ctx.configHandler(rec, httptest.NewRequest(http.MethodPost, "/config", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %v, want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	if err := ctx.addRecord("app", []byte(`{"message":"hello"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	flushBuffer(ctx, "app")
+
+	rec := httptest.NewRecorder()
+	ctx.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	var status PluginStatus
+	if err := jsoniter.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Retrying || status.Retries != 1 || status.LastError != "service unavailable" {
+		t.Errorf("status = %+v, want the failed flush reported", status)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Alerter posts a JSON payload to a webhook once flushes keep failing
+type Alerter struct {
+	URL       string
+	Threshold int
+	Interval  time.Duration
+	HTTP      *http.Client
+
+	failures  int
+	lastAlert time.Time
+}
+
+type alertPayload struct {
+	ErrorClass          string `json:"error_class"`
+	Error               string `json:"error"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Bucket              string `json:"bucket"`
+	Tag                 string `json:"tag"`
+	Time                string `json:"time"`
+}
+
+// NewAlerter : alert url after threshold consecutive failures, at most once per interval
+func NewAlerter(url string, threshold int, interval time.Duration) *Alerter {
+	return &Alerter{
+		URL:       url,
+		Threshold: threshold,
+		Interval:  interval,
+		HTTP:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// RecordSuccess resets the consecutive failure count
+func (a *Alerter) RecordSuccess() {
+	if a == nil {
+		return
+	}
+	a.failures = 0
+}
+
+// RecordFailure counts a failed write and notifies the webhook once the threshold is crossed
+func (a *Alerter) RecordFailure(bucket, tag string, cause error) {
+	if a == nil {
+		return
+	}
+	a.failures++
+	if a.failures < a.Threshold {
+		return
+	}
+
+	now := time.Now()
+	if !a.lastAlert.IsZero() && now.Sub(a.lastAlert) < a.Interval {
+		return
+	}
+	a.lastAlert = now
+
+	payload := alertPayload{
+		ErrorClass:          fmt.Sprintf("%T", cause),
+		Error:               cause.Error(),
+		ConsecutiveFailures: a.failures,
+		Bucket:              bucket,
+		Tag:                 tag,
+		Time:                now.Format(time.RFC3339),
+	}
+	go a.post(payload)
+}
+
+func (a *Alerter) post(payload alertPayload) {
+	body, err := jsoniter.Marshal(payload)
+	if err != nil {
+		log.Printf("[warn] error encoding alert payload: %v\n", err)
+		return
+	}
+
+	resp, err := a.HTTP.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[warn] error sending alert to webhook: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[warn] alert webhook returned status %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestAlerterThreshold(t *testing.T) {
+	received := make(chan alertPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload alertPayload
+		if err := jsoniter.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid payload: %v", err)
+		}
+		received <- payload
+	}))
+	defer server.Close()
+
+	alerter := NewAlerter(server.URL, 3, time.Hour)
+	cause := errors.New("permission denied")
+
+	alerter.RecordFailure("bucket", "app", cause)
+	alerter.RecordFailure("bucket", "app", cause)
+	select {
+	case <-received:
+		t.Fatal("webhook called before threshold")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	alerter.RecordFailure("bucket", "app", cause)
+	select {
+	case payload := <-received:
+		if payload.ConsecutiveFailures != 3 {
+			t.Errorf("ConsecutiveFailures = %v, want %v", payload.ConsecutiveFailures, 3)
+		}
+		if payload.Bucket != "bucket" || payload.Tag != "app" {
+			t.Errorf("payload = %+v, want bucket %v and tag %v", payload, "bucket", "app")
+		}
+		if payload.Error != "permission denied" {
+			t.Errorf("Error = %v, want %v", payload.Error, "permission denied")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called after threshold")
+	}
+
+	// rate limited within the interval
+	alerter.RecordFailure("bucket", "app", cause)
+	select {
+	case <-received:
+		t.Fatal("webhook called again within interval")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Backoff_Strategy values, how the delay between retries of a failing
+// buffer grows
+const (
+	backoffExponential = "exponential"
+	backoffLinear      = "linear"
+	backoffConstant    = "constant"
+)
+
+// Retries start retryBaseDelay after the first failure and wait at most retryMaxDelay
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// Backoff spaces out the retries of failing buffers
+type Backoff struct {
+	// Strategy is one of the Backoff_Strategy values, backoffExponential when empty
+	Strategy string
+	// Jitter draws each delay uniformly between 0 and the computed one, so
+	// instances failing together don't retry in lockstep
+	Jitter bool
+}
+
+// Delay : the delay before retrying a flush that failed attempts times in a
+// row. Exponential doubles retryBaseDelay on every failure, linear adds it
+// and constant keeps it, all capped at retryMaxDelay before any Jitter.
+func (b Backoff) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := retryBaseDelay
+	switch b.Strategy {
+	case backoffConstant:
+	case backoffLinear:
+		delay = retryBaseDelay * time.Duration(attempts)
+	default:
+		for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	if b.Jitter {
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
+
+// parseBackoffStrategy : read a Backoff_Strategy value, exponential when
+// missing or invalid
+func parseBackoffStrategy(value string) string {
+	switch strategy := strings.ToLower(strings.TrimSpace(value)); strategy {
+	case "":
+		return backoffExponential
+	case backoffExponential, backoffLinear, backoffConstant:
+		return strategy
+	default:
+		log.Printf("[warn] Invalid backoff strategy: %s, using %s\n", value, backoffExponential)
+		return backoffExponential
+	}
+}
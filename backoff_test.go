@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     []time.Duration
+	}{
+		{"", []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{backoffExponential, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{backoffLinear, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second}},
+		{backoffConstant, []time.Duration{time.Second, time.Second, time.Second, time.Second}},
+	}
+	for _, tt := range tests {
+		backoff := Backoff{Strategy: tt.strategy}
+		for i, want := range tt.want {
+			if got := backoff.Delay(i + 1); got != want {
+				t.Errorf("%q Delay(%d) = %v, want %v", tt.strategy, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayCap(t *testing.T) {
+	for _, strategy := range []string{backoffExponential, backoffLinear, backoffConstant} {
+		backoff := Backoff{Strategy: strategy}
+		for _, attempts := range []int{100, 1000, 1 << 30} {
+			if got := backoff.Delay(attempts); got <= 0 || got > retryMaxDelay {
+				t.Errorf("%q Delay(%d) = %v, want at most %v", strategy, attempts, got, retryMaxDelay)
+			}
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	const samples = 10000
+	backoff := Backoff{Strategy: backoffExponential, Jitter: true}
+	for _, attempts := range []int{1, 4, 100} {
+		max := Backoff{Strategy: backoffExponential}.Delay(attempts)
+		var sum time.Duration
+		for i := 0; i < samples; i++ {
+			got := backoff.Delay(attempts)
+			if got < 0 || got > max {
+				t.Fatalf("Delay(%d) = %v, want between 0 and %v", attempts, got, max)
+			}
+			sum += got
+		}
+		if mean := sum / samples; mean < max*45/100 || mean > max*55/100 {
+			t.Errorf("mean Delay(%d) = %v, want about %v", attempts, mean, max/2)
+		}
+	}
+}
+
+func TestParseBackoffStrategy(t *testing.T) {
+	for value, want := range map[string]string{
+		"":            backoffExponential,
+		"Linear":      backoffLinear,
+		"constant":    backoffConstant,
+		"exponential": backoffExponential,
+		"random":      backoffExponential,
+	} {
+		if got := parseBackoffStrategy(value); got != want {
+			t.Errorf("parseBackoffStrategy(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// compactionHintFile is written in each partition listing its small objects
+const compactionHintFile = "_compact_candidates.json"
+
+// compactionHintInterval is the least time between two writes of the hint
+// file of a partition, candidates landing in between are written together
+const compactionHintInterval = time.Minute
+
+// compactionPartitionIdle closes partitions without a new candidate for
+// that long: their hint file is written a last time and they are forgotten
+const compactionPartitionIdle = time.Hour
+
+// CompactionHints tracks objects written below Threshold bytes, per
+// partition, so an out-of-band job can merge them later
+type CompactionHints struct {
+	Threshold  int64
+	partitions map[string]*partitionHints
+}
+
+// partitionHints are the candidates of a partition and the state of its hint file
+type partitionHints struct {
+	tag     string
+	objects []compactionCandidate
+	// loaded is set once the hint file left by a previous process or an
+	// earlier opening of the partition has been merged
+	loaded bool
+	// dirty is set when objects changed since the hint file was written
+	dirty   bool
+	added   time.Time
+	written time.Time
+}
+
+type compactionCandidate struct {
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+}
+
+type compactionHint struct {
+	Partition string                `json:"partition"`
+	Objects   []compactionCandidate `json:"objects"`
+}
+
+// hintFile is a partition hint file due for writing
+type hintFile struct {
+	Tag       string
+	Partition string
+	Key       string
+}
+
+// NewCompactionHints : track objects smaller than threshold bytes
+func NewCompactionHints(threshold int64) *CompactionHints {
+	return &CompactionHints{
+		Threshold:  threshold,
+		partitions: make(map[string]*partitionHints),
+	}
+}
+
+// Record notes an object of tag written at now, kept as a candidate of its
+// partition when below Threshold
+func (h *CompactionHints) Record(tag, objectKey string, size int64, now time.Time) {
+	if h == nil || size >= h.Threshold {
+		return
+	}
+
+	partition := path.Dir(objectKey)
+	hints, ok := h.partitions[partition]
+	if !ok {
+		hints = &partitionHints{tag: tag}
+		h.partitions[partition] = hints
+	}
+	hints.objects = append(hints.objects, compactionCandidate{Object: objectKey, Size: size})
+	hints.dirty = true
+	hints.added = now
+}
+
+// Due : the hint files to write at now, oldest partition first. A changed
+// partition is written at most once per compactionHintInterval, or right
+// away when final is set. Partitions idle for compactionPartitionIdle are
+// forgotten once written.
+func (h *CompactionHints) Due(now time.Time, final bool) []hintFile {
+	if h == nil {
+		return nil
+	}
+
+	var due []hintFile
+	for partition, hints := range h.partitions {
+		idle := now.Sub(hints.added) >= compactionPartitionIdle
+		if hints.dirty && (final || idle || now.Sub(hints.written) >= compactionHintInterval) {
+			due = append(due, hintFile{Tag: hints.tag, Partition: partition, Key: path.Join(partition, compactionHintFile)})
+		} else if idle {
+			delete(h.partitions, partition)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Partition < due[j].Partition
+	})
+	return due
+}
+
+// Loaded : whether the hint file already stored for partition was merged
+func (h *CompactionHints) Loaded(partition string) bool {
+	return h.partitions[partition].loaded
+}
+
+// Load merges the candidates of the hint file stored for partition ahead
+// of those recorded since
+func (h *CompactionHints) Load(partition string, stored []byte) {
+	hints := h.partitions[partition]
+	hints.loaded = true
+	if stored == nil {
+		return
+	}
+
+	var hint compactionHint
+	if err := jsoniter.Unmarshal(stored, &hint); err != nil {
+		log.Printf("[warn] ignoring unreadable compaction hint of %s: %v\n", partition, err)
+		return
+	}
+	listed := make(map[string]bool, len(hints.objects))
+	for _, candidate := range hints.objects {
+		listed[candidate.Object] = true
+	}
+	var objects []compactionCandidate
+	for _, candidate := range hint.Objects {
+		if !listed[candidate.Object] {
+			objects = append(objects, candidate)
+		}
+	}
+	hints.objects = append(objects, hints.objects...)
+}
+
+// Hint : the content of the hint file of partition
+func (h *CompactionHints) Hint(partition string) ([]byte, error) {
+	return jsoniter.Marshal(compactionHint{Partition: partition, Objects: h.partitions[partition].objects})
+}
+
+// Written marks the hint file of partition written at now, forgetting the
+// partition once idle
+func (h *CompactionHints) Written(partition string, now time.Time) {
+	hints := h.partitions[partition]
+	hints.dirty = false
+	hints.written = now
+	if now.Sub(hints.added) >= compactionPartitionIdle {
+		delete(h.partitions, partition)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
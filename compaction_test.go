@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestCompactionHints(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.CompactionHints = NewCompactionHints(200)
+
+	// two small objects and one large, incompressible object
+	for _, records := range []int{1, 2} {
+		for i := 0; i < records; i++ {
+			if err := ctx.addRecord("app", []byte(fmt.Sprintf(`{"id":%d}`, i)), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		line := fmt.Sprintf(`{"id":%d,"value":"%s"}`, i, uuid.Must(uuid.NewRandom()).String())
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	ctx.writeCompactionHints(time.Now(), true)
+
+	var hintKey string
+	var small []string
+	for key, data := range client.objects {
+		switch {
+		case strings.HasSuffix(key, "/"+compactionHintFile):
+			hintKey = key
+		case len(data) < 200:
+			small = append(small, strings.TrimPrefix(key, "bucket/"))
+		}
+	}
+	if hintKey == "" {
+		t.Fatal("no compaction hint file written")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(client.objects[hintKey]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hint compactionHint
+	if err := jsoniter.Unmarshal(data, &hint); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hint.Objects) != len(small) || len(small) != 2 {
+		t.Fatalf("hint lists %d objects, want the %d small ones", len(hint.Objects), len(small))
+	}
+	for _, candidate := range hint.Objects {
+		found := false
+		for _, key := range small {
+			if candidate.Object == key {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("hint lists %v which is not a small object", candidate.Object)
+		}
+	}
+}
+
+func TestCompactionHintsBatching(t *testing.T) {
+	hints := NewCompactionHints(200)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		hints.Record("app", fmt.Sprintf("logs/app/2024/04/01/%d.log.gz", i), 100, now)
+	}
+	due := hints.Due(now, false)
+	if len(due) != 1 || due[0].Key != "logs/app/2024/04/01/"+compactionHintFile {
+		t.Fatalf("Due() = %v, want the single partition hint", due)
+	}
+	hints.Load(due[0].Partition, nil)
+	hints.Written(due[0].Partition, now)
+
+	// a candidate within the interval waits for the next write
+	hints.Record("app", "logs/app/2024/04/01/3.log.gz", 100, now.Add(time.Second))
+	if due := hints.Due(now.Add(time.Second), false); len(due) != 0 {
+		t.Errorf("Due() = %v within %v of the last write, want none", due, compactionHintInterval)
+	}
+	if due := hints.Due(now.Add(time.Second), true); len(due) != 1 {
+		t.Errorf("final Due() = %v, want the changed partition", due)
+	}
+	due = hints.Due(now.Add(compactionHintInterval), false)
+	if len(due) != 1 {
+		t.Fatalf("Due() = %v after %v, want the changed partition", due, compactionHintInterval)
+	}
+	hint, err := hints.Hint(due[0].Partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded compactionHint
+	if err := jsoniter.Unmarshal(hint, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Objects) != 4 {
+		t.Errorf("hint lists %d objects, want %d", len(decoded.Objects), 4)
+	}
+	hints.Written(due[0].Partition, now.Add(compactionHintInterval))
+
+	// idle partitions are closed and forgotten
+	hints.Due(now.Add(compactionPartitionIdle+time.Second), false)
+	if len(hints.partitions) != 0 {
+		t.Errorf("partitions tracked = %v, want idle ones dropped", len(hints.partitions))
+	}
+}
+
+func TestCompactionHintsMergeStored(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.CompactionHints = NewCompactionHints(200)
+
+	hintKey := "logs/app/2024/04/01/" + compactionHintFile
+	stored, err := jsoniter.Marshal(compactionHint{
+		Partition: "logs/app/2024/04/01",
+		Objects:   []compactionCandidate{{Object: "logs/app/2024/04/01/old.log.gz", Size: 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := compress(stored, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.objects["bucket/"+hintKey] = content.Bytes()
+
+	ctx.CompactionHints.Record("app", "logs/app/2024/04/01/new.log.gz", 60, time.Now())
+	ctx.writeCompactionHints(time.Now(), true)
+
+	zr, err := gzip.NewReader(bytes.NewReader(client.objects["bucket/"+hintKey]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hint compactionHint
+	if err := jsoniter.Unmarshal(data, &hint); err != nil {
+		t.Fatal(err)
+	}
+	if len(hint.Objects) != 2 || hint.Objects[0].Object != "logs/app/2024/04/01/old.log.gz" {
+		t.Errorf("hint objects = %v, want the stored candidate kept ahead of the new one", hint.Objects)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CompactionQueue holds the directories that got objects below
+// CompactionThreshold since they were last compacted, with the write time
+// of the oldest, so the compactor lists these directories only
+type CompactionQueue struct {
+	mu      sync.Mutex
+	pending map[compactionDir]time.Time
+}
+
+// compactionDir is a directory of objects in a bucket
+type compactionDir struct {
+	bucket string
+	dir    string
+}
+
+// NewCompactionQueue : an empty compaction queue
+func NewCompactionQueue() *CompactionQueue {
+	return &CompactionQueue{pending: make(map[compactionDir]time.Time)}
+}
+
+// Record notes a small object of bucket written at t. Safe to call concurrently.
+func (q *CompactionQueue) Record(bucket, objectKey string, t time.Time) {
+	if q == nil {
+		return
+	}
+	q.add(compactionDir{bucket: bucket, dir: path.Dir(objectKey)}, t)
+}
+
+func (q *CompactionQueue) add(key compactionDir, t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if oldest, ok := q.pending[key]; !ok || t.Before(oldest) {
+		q.pending[key] = t
+	}
+}
+
+// Take : remove and return the directories of bucket below prefix holding
+// objects written before the hour of now, with the write time of their
+// oldest object
+func (q *CompactionQueue) Take(bucket, prefix string, now time.Time) map[string]time.Time {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	currentHour := toJstTime(now).Truncate(time.Hour)
+	due := make(map[string]time.Time)
+	for key, oldest := range q.pending {
+		if key.bucket != bucket || !strings.HasPrefix(key.dir, prefix+"/") {
+			continue
+		}
+		if toJstTime(oldest).Truncate(time.Hour).Before(currentHour) {
+			due[key.dir] = oldest
+			delete(q.pending, key)
+		}
+	}
+	return due
+}
+
+// startCompactor : merge the small objects of past hours every interval
+func (p *PluginContext) startCompactor(interval time.Duration) {
+	stop := make(chan struct{})
+	p.CompactorStop = stop
+	if p.CompactionQueue == nil {
+		p.CompactionQueue = NewCompactionQueue()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// only the immutable config and the clients are used, so
+				// flushes carry on while objects are merged
+				if err := p.compact(time.Now()); err != nil {
+					p.Warnf("error compacting objects: %v\n", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCompactor : stop the compaction task. Must be called with mutex held.
+func (p *PluginContext) stopCompactor() {
+	if p.CompactorStop != nil {
+		close(p.CompactorStop)
+		p.CompactorStop = nil
+	}
+}
+
+// compact : merge the objects below CompactionThreshold written in the same
+// directory and hour, for every hour ended before now. Only the directories
+// CompactionQueue holds for a past hour are listed. The gzip members of
+// the merged objects decompress as one stream.
+func (p *PluginContext) compact(now time.Time) error {
+	if p.DryRun {
+		return nil
+	}
+	for _, dst := range p.destinations() {
+		compactor, ok := dst.client.(ObjectCompactor)
+		if !ok {
+			continue
+		}
+		due := p.CompactionQueue.Take(dst.bucket, dst.prefix, now)
+		for dir, oldest := range due {
+			if err := p.compactDir(compactor, dst.bucket, dir, now); err != nil {
+				// the directory is listed again on the next tick
+				p.CompactionQueue.add(compactionDir{bucket: dst.bucket, dir: dir}, oldest)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactDir : merge the small objects of the past hours of dir, leaving
+// the objects of the current hour queued
+func (p *PluginContext) compactDir(compactor ObjectCompactor, bucket, dir string, now time.Time) error {
+	objects, err := compactor.ListObjects(bucket, dir+"/")
+	if err != nil {
+		return err
+	}
+	currentHour := toJstTime(now).Truncate(time.Hour)
+	for _, object := range objects {
+		if object.Size >= p.CompactionThreshold {
+			continue
+		}
+		if !toJstTime(object.Created).Truncate(time.Hour).Before(currentHour) {
+			p.CompactionQueue.Record(bucket, object.Name, object.Created)
+		}
+	}
+
+	infos := make(map[string]ObjectInfo, len(objects))
+	for _, object := range objects {
+		infos[object.Name] = object
+	}
+	for group, sources := range p.compactionGroups(objects, now) {
+		// the merged object keeps the storage class of the oldest source
+		opts := WriteOptions{StorageClass: infos[sources[0]].StorageClass}
+		for _, source := range sources {
+			opts.Metadata = mergeMetadata(opts.Metadata, infos[source].Metadata)
+		}
+		object := fmt.Sprintf("%s_compacted_%s.log.gz", group, uuid.Must(uuid.NewRandom()).String())
+		if err := compactor.Compose(bucket, object, sources, opts); err != nil {
+			return err
+		}
+		p.Infof("compacted %d objects into %s\n", len(sources), object)
+	}
+	return nil
+}
+
+// compactionGroups : the small objects to merge, keyed by the DIR/hour
+// prefix of their merged object, oldest object first
+func (p *PluginContext) compactionGroups(objects []ObjectInfo, now time.Time) map[string][]string {
+	currentHour := toJstTime(now).Truncate(time.Hour)
+	candidates := make(map[string][]ObjectInfo)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Name, ".log.gz") || object.Size >= p.CompactionThreshold {
+			continue
+		}
+		// the current hour may still receive objects
+		hour := toJstTime(object.Created).Truncate(time.Hour)
+		if !hour.Before(currentHour) {
+			continue
+		}
+		group := fmt.Sprintf("%s/%d", path.Dir(object.Name), hour.Unix())
+		candidates[group] = append(candidates[group], object)
+	}
+
+	groups := make(map[string][]string)
+	for group, objects := range candidates {
+		if len(objects) < 2 {
+			continue
+		}
+		sort.SliceStable(objects, func(i, j int) bool {
+			return objects[i].Created.Before(objects[j].Created)
+		})
+		for _, object := range objects {
+			groups[group] = append(groups[group], object.Name)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compactingClient lists objects with their creation time and composes them
+type compactingClient struct {
+	*mockClient
+	created map[string]time.Time
+	// listed are the prefixes listed
+	listed []string
+}
+
+func (c *compactingClient) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	c.listed = append(c.listed, prefix)
+	var objects []ObjectInfo
+	for key, data := range c.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, ObjectInfo{Name: name, Size: int64(len(data)), Created: c.created[name]})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (c *compactingClient) Compose(bucket, object string, sources []string, opts WriteOptions) error {
+	var merged []byte
+	for _, source := range sources {
+		merged = append(merged, c.objects[bucket+"/"+source]...)
+		delete(c.objects, bucket+"/"+source)
+	}
+	c.objects[bucket+"/"+object] = merged
+	return nil
+}
+
+func TestCompactor(t *testing.T) {
+	client := &compactingClient{mockClient: newMockClient(), created: make(map[string]time.Time)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.CompactionThreshold = 1024
+	ctx.CompactionQueue = NewCompactionQueue()
+
+	now := time.Date(2024, 4, 1, 12, 30, 0, 0, time.FixedZone("JST", 9*60*60))
+	write := func(name, record string, created time.Time) {
+		data, err := compress([]byte(record+"\n"), gzip.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.objects["bucket/"+name] = data.Bytes()
+		client.created[name] = created
+		ctx.CompactionQueue.Record("bucket", name, created)
+	}
+	write("logs/app/2024/04/01/1711940400_c.log.gz", `{"n":3}`, now.Add(-80*time.Minute))
+	write("logs/app/2024/04/01/1711940000_a.log.gz", `{"n":1}`, now.Add(-90*time.Minute))
+	write("logs/app/2024/04/01/1711940200_b.log.gz", `{"n":2}`, now.Add(-85*time.Minute))
+	write("logs/app/2024/04/01/1711944000_d.log.gz", `{"n":4}`, now.Add(-10*time.Minute))
+	write("logs/app/2024/04/01/1711944100_e.log.gz", `{"n":5}`, now.Add(-5*time.Minute))
+
+	if err := ctx.compact(now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"logs/app/2024/04/01/"}; !reflect.DeepEqual(client.listed, want) {
+		t.Errorf("listed = %q, want %q", client.listed, want)
+	}
+	if len(client.objects) != 3 {
+		t.Fatalf("objects = %v, want the past hour merged and the current hour kept", len(client.objects))
+	}
+	for _, kept := range []string{"1711944000_d", "1711944100_e"} {
+		if _, ok := client.objects["bucket/logs/app/2024/04/01/"+kept+".log.gz"]; !ok {
+			t.Errorf("current hour object %v compacted, want it kept", kept)
+		}
+	}
+
+	for key, data := range client.objects {
+		if !strings.Contains(key, "_compacted_") {
+			continue
+		}
+		if !strings.HasPrefix(key, "bucket/logs/app/2024/04/01/") {
+			t.Errorf("compacted object = %v, want it in the partition of its sources", key)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; string(got) != want {
+			t.Errorf("compacted content = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCompactorListsQueuedDirectories(t *testing.T) {
+	client := &compactingClient{mockClient: newMockClient(), created: make(map[string]time.Time)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.CompactionThreshold = 1024
+	ctx.CompactionQueue = NewCompactionQueue()
+
+	written := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := ctx.addRecord("app", []byte(`{"message":"hello"}`), written); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := range client.objects {
+		client.created[strings.TrimPrefix(key, "bucket/")] = written
+	}
+
+	// the flushed objects are of the current hour, nothing is listed
+	if err := ctx.compact(written); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.listed) != 0 {
+		t.Errorf("listed = %q in the hour the objects were written, want none", client.listed)
+	}
+
+	// their directory is listed once the hour is over, and no more after
+	for i := 0; i < 2; i++ {
+		if err := ctx.compact(written.Add(2 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.listed) != 1 || len(client.objects) != 1 {
+		t.Errorf("listed = %q leaving %v objects, want one listing merging both", client.listed, len(client.objects))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// heartbeatTag is the key segment heartbeat objects are written under
+const heartbeatTag = "_heartbeat"
+
+// startHeartbeat : write a heartbeat object through the regular write path
+// every interval, proving connectivity while no records arrive
+func (p *PluginContext) startHeartbeat(interval time.Duration) {
+	stop := make(chan struct{})
+	p.HeartbeatStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mutex.Lock()
+				if err := p.writeHeartbeat(getCurrentJstTime()); err != nil {
+					p.Warnf("error writing heartbeat: %v\n", err)
+				}
+				mutex.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopHeartbeat : stop the heartbeat task. Must be called with mutex held.
+func (p *PluginContext) stopHeartbeat() {
+	if p.HeartbeatStop != nil {
+		close(p.HeartbeatStop)
+		p.HeartbeatStop = nil
+	}
+}
+
+// writeHeartbeat : write a small object under PREFIX/_heartbeat/
+func (p *PluginContext) writeHeartbeat(now time.Time) error {
+	data := []byte(fmt.Sprintf(`{"%s":"%s"}`+"\n", heartbeatTag, now.Format(time.RFC3339Nano)))
+	objectKey := p.KeyFormat.ObjectKey(p.destination(heartbeatTag).prefix, heartbeatTag, now, data)
+	content := compressStream(data, p.CompressionLevel, p.CompressBufferSize)
+	defer content.Close()
+	return p.upload(heartbeatTag, objectKey, content, WriteOptions{})
+}
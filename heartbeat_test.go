@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	mutex.Lock()
+	ctx.startHeartbeat(20 * time.Millisecond)
+	mutex.Unlock()
+	time.Sleep(110 * time.Millisecond)
+	mutex.Lock()
+	ctx.stopHeartbeat()
+	defer mutex.Unlock()
+
+	if len(client.objects) < 3 || len(client.objects) > 6 {
+		t.Errorf("heartbeat objects = %v, want about %v", len(client.objects), 5)
+	}
+	for key := range client.objects {
+		if !strings.HasPrefix(key, "bucket/logs/"+heartbeatTag+"/") {
+			t.Errorf("object key = %v, want it under %v", key, heartbeatTag)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultDateFormat renders nested YEAR/MONTH/DAY key segments
+const defaultDateFormat = "2006/01/02"
+
+// Object_Suffix values selecting the unique component of object names
+const (
+	suffixUUID     = "uuid"
+	suffixSequence = "sequence"
+	suffixNanos    = "nanos"
+)
+
+// Partition_Granularity values appending time segments below the date
+const (
+	granularityDay    = "day"
+	granularityHour   = "hour"
+	granularityMinute = "minute"
+)
+
+// objectSequence numbers the objects named with suffixSequence in this process
+var objectSequence uint64
+
+// lastObjectNanos is the last timestamp handed out for suffixNanos
+var lastObjectNanos int64
+
+// KeyFormat controls the layout of generated object keys
+type KeyFormat struct {
+	// DateFormat is the Go reference layout of the date segment
+	DateFormat string
+	// DedupeByContent names objects after the sha256 of their content, so
+	// a retried flush of the same buffer overwrites the same object
+	DedupeByContent bool
+	// WriterID is appended to object names so concurrent writers of the
+	// same partition never collide, empty omits it
+	WriterID string
+	// Suffix is the unique component of object names, suffixUUID when empty
+	Suffix string
+	// LexicalOrdering names objects after their zero-padded write time in
+	// nanoseconds, so the keys of a partition sort in write order. Object
+	// names fixed by Hourly or DedupeByContent are left as they are.
+	LexicalOrdering bool
+	// Hourly names objects after the hour of their time, so every flush of
+	// an hour targets the same object
+	Hourly bool
+	// Granularity adds HH or HH/mm segments below the date, granularityDay
+	// when empty
+	Granularity string
+}
+
+// GenerateObjectKey : gen format object name PREFIX/tag/YEAR/MONTH/DAY/timestamp_uuid.log
+func GenerateObjectKey(prefix, tag string, t time.Time) string {
+	return KeyFormat{}.ObjectKey(prefix, tag, t, nil)
+}
+
+// ObjectKey : gen format object name PREFIX/tag/DATE/timestamp_uuid.log, t
+// is expected in the timezone the date segment is rendered in. data is the
+// uncompressed content of the object, used with DedupeByContent.
+func (f KeyFormat) ObjectKey(prefix, tag string, t time.Time, data []byte) string {
+	return f.objectKey(prefix, tag, t, data, false)
+}
+
+// objectKey : ObjectKey, with peek rendering the unique component the next
+// object would get without handing it out
+func (f KeyFormat) objectKey(prefix, tag string, t time.Time, data []byte, peek bool) string {
+	var name string
+	if f.Hourly {
+		name = t.Format("15")
+	} else if f.DedupeByContent {
+		sum := sha256.Sum256(data)
+		name = hex.EncodeToString(sum[:])
+	} else if f.LexicalOrdering {
+		// unlike the partition time, the write time only moves forward
+		name = fmt.Sprintf("%019d", nextNanos(peek))
+	} else {
+		name = fmt.Sprintf("%d_%s", t.Unix(), f.uniqueSuffix(peek))
+	}
+	if f.WriterID != "" {
+		name += "_" + strings.ReplaceAll(f.WriterID, "/", "_")
+	}
+	fileName := fmt.Sprintf("%s/%s.log.gz", t.Format(f.partitionFormat()), name)
+	return filepath.Join(sanitizeKeyPath(prefix), sanitizeKeyPath(tag), fileName)
+}
+
+// PreviewObjectKey : render the key an object of tag holding data written at
+// t would get with the plugin settings of config, keyed like the fluent-bit
+// section (Prefix, Date_Format, Partition_Granularity, Object_Suffix,
+// Writer_ID, Append_Mode, Dedupe_By_Content, Lexical_Ordering). Meant for
+// checking a key layout without running the plugin, it hands out no
+// sequence number or timestamp to the objects written later.
+func PreviewObjectKey(config map[string]string, tag string, t time.Time, data []byte) (string, error) {
+	get := func(key string) string {
+		for k, v := range config {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	prefix := get("Prefix")
+	if prefix == "" {
+		return "", fmt.Errorf("prefix is not set")
+	}
+	format := KeyFormat{
+		DateFormat: get("Date_Format"),
+		WriterID:   get("Writer_ID"),
+		Suffix:     strings.ToLower(get("Object_Suffix")),
+		Hourly:     parseBool(get("Append_Mode"), false),
+
+		DedupeByContent: parseBool(get("Dedupe_By_Content"), false),
+		LexicalOrdering: parseBool(get("Lexical_Ordering"), false),
+
+		Granularity: strings.ToLower(get("Partition_Granularity")),
+	}
+	if !validSuffix(format.Suffix) {
+		return "", fmt.Errorf("invalid Object_Suffix %q, want %s, %s or %s", format.Suffix, suffixUUID, suffixSequence, suffixNanos)
+	}
+	if !validGranularity(format.Granularity) {
+		return "", fmt.Errorf("invalid Partition_Granularity %q, want %s, %s or %s", format.Granularity, granularityDay, granularityHour, granularityMinute)
+	}
+	if layout := format.dateFormat(); t.Format(layout) == layout {
+		return "", fmt.Errorf("date format %q has no date elements", layout)
+	}
+	return format.objectKey(prefix, tag, toJstTime(t), data, true), nil
+}
+
+// validSuffix : whether suffix is an Object_Suffix value, empty for the default
+func validSuffix(suffix string) bool {
+	switch suffix {
+	case "", suffixUUID, suffixSequence, suffixNanos:
+		return true
+	}
+	return false
+}
+
+// dateFormat : the layout of the date segment, defaultDateFormat when unset
+func (f KeyFormat) dateFormat() string {
+	if f.DateFormat == "" {
+		return defaultDateFormat
+	}
+	return f.DateFormat
+}
+
+// partitionFormat : the layout of the key segments between the tag and the
+// file name, the date followed by the Granularity segments
+func (f KeyFormat) partitionFormat() string {
+	switch f.Granularity {
+	case granularityHour:
+		return f.dateFormat() + "/15"
+	case granularityMinute:
+		return f.dateFormat() + "/15/04"
+	}
+	return f.dateFormat()
+}
+
+// validGranularity : whether granularity is a Partition_Granularity value, empty for the default
+func validGranularity(granularity string) bool {
+	switch granularity {
+	case "", granularityDay, granularityHour, granularityMinute:
+		return true
+	}
+	return false
+}
+
+// uniqueSuffix : the component telling apart objects written in the same
+// second, only looked at and not handed out with peek
+func (f KeyFormat) uniqueSuffix(peek bool) string {
+	switch f.Suffix {
+	case suffixSequence:
+		if peek {
+			return fmt.Sprintf("%012d", atomic.LoadUint64(&objectSequence)+1)
+		}
+		return fmt.Sprintf("%012d", atomic.AddUint64(&objectSequence, 1))
+	case suffixNanos:
+		return fmt.Sprintf("%d", nextNanos(peek))
+	default:
+		return uuid.Must(uuid.NewRandom()).String()
+	}
+}
+
+// uniqueNanos : the current unix time in nanoseconds, moved past the last
+// value returned so keys of a coarse clock never collide
+func uniqueNanos() int64 {
+	for {
+		last := atomic.LoadInt64(&lastObjectNanos)
+		now := time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastObjectNanos, last, now) {
+			return now
+		}
+	}
+}
+
+// nextNanos : uniqueNanos, only looked at and not handed out with peek
+func nextNanos(peek bool) int64 {
+	if !peek {
+		return uniqueNanos()
+	}
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&lastObjectNanos); now <= last {
+		now = last + 1
+	}
+	return now
+}
+
+// sanitizeKeyPath : escape "." and ".." segments so a prefix or tag can't climb out of its directory
+func sanitizeKeyPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "." || segment == ".." {
+			segments[i] = strings.Repeat("_", len(segment))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// repeatObjectKey : add the number of a repeated key ahead of its extension
+func repeatObjectKey(objectKey string, n int) string {
+	return fmt.Sprintf("%s_%d.log.gz", strings.TrimSuffix(objectKey, ".log.gz"), n)
+}
+
+// partObjectKey : add a part number to an object key ahead of its extension
+func partObjectKey(objectKey string, part int) string {
+	return fmt.Sprintf("%s_part%04d.log.gz", strings.TrimSuffix(objectKey, ".log.gz"), part+1)
+}
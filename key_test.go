@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupeByContent(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.KeyFormat.DedupeByContent = true
+
+	for i := 0; i < 2; i++ {
+		if err := ctx.addRecord("app", []byte(`{"msg":"same"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.objects) != 1 {
+		t.Errorf("objects written = %v, want a single key for identical content", len(client.objects))
+	}
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"other"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 2 {
+		t.Errorf("objects written = %v, want a new key for different content", len(client.objects))
+	}
+}
+
+func TestDedupeByContentSubpartitions(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.KeyFormat.DedupeByContent = true
+	ctx.SubpartitionByEventTime = true
+
+	// identical records of three minutes are three batches of one flush
+	eventTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := ctx.addRecord("app", []byte(`{"msg":"same"}`), eventTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 3 {
+		t.Fatalf("objects written = %v, want one per batch", len(client.objects))
+	}
+	var keys []string
+	for key := range client.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !strings.HasSuffix(keys[1], "_2.log.gz") || !strings.HasSuffix(keys[2], "_3.log.gz") {
+		t.Errorf("object keys = %v, want the repeated key numbered", keys)
+	}
+
+	// retrying the same flush issues the same keys
+	first := append([]string{}, keys...)
+	for i := 0; i < 3; i++ {
+		ctx.addRecord("app", []byte(`{"msg":"same"}`), eventTime.Add(time.Duration(i)*time.Minute))
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != len(first) {
+		t.Errorf("objects written = %v after the same flush again, want %v", len(client.objects), len(first))
+	}
+}
+
+func TestAppendModeBatchesShareHourlyObject(t *testing.T) {
+	client := &appendClient{mockClient: newMockClient()}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.AppendMode = true
+	ctx.KeyFormat.Hourly = true
+	ctx.SubpartitionByEventTime = true
+
+	eventTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := ctx.addRecord("app", []byte(`{"msg":"same"}`), eventTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// both batches are appended to the hourly object, neither overwrites the other
+	if got := objectLines(t, client.mockClient); len(got) != 2 {
+		t.Errorf("written lines = %v, want both batches", got)
+	}
+}
+
+func TestWriterID(t *testing.T) {
+	ts := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	data := []byte(`{"msg":"same"}` + "\n")
+
+	first := KeyFormat{DedupeByContent: true, WriterID: "writer-a"}.ObjectKey("logs", "app", ts, data)
+	second := KeyFormat{DedupeByContent: true, WriterID: "writer-b"}.ObjectKey("logs", "app", ts, data)
+	if first == second {
+		t.Fatalf("ObjectKey() = %v for both writers, want distinct keys", first)
+	}
+	if strings.TrimSuffix(first, "_writer-a.log.gz") != strings.TrimSuffix(second, "_writer-b.log.gz") {
+		t.Errorf("keys %v and %v differ beyond the writer segment", first, second)
+	}
+
+	key := KeyFormat{WriterID: "zone/a"}.ObjectKey("logs", "app", ts, nil)
+	if !strings.HasSuffix(key, "_zone_a.log.gz") {
+		t.Errorf("ObjectKey() = %v, want suffix %v", key, "_zone_a.log.gz")
+	}
+}
+
+func TestObjectSuffix(t *testing.T) {
+	ts := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	format := KeyFormat{Suffix: suffixSequence}
+	previous := format.ObjectKey("logs", "app", ts, nil)
+	for i := 0; i < 20; i++ {
+		key := format.ObjectKey("logs", "app", ts, nil)
+		if key <= previous {
+			t.Fatalf("ObjectKey() = %v after %v, want increasing keys", key, previous)
+		}
+		previous = key
+	}
+
+	format = KeyFormat{Suffix: suffixUUID}
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := format.ObjectKey("logs", "app", ts, nil)
+		if seen[key] {
+			t.Fatalf("ObjectKey() = %v twice, want random keys", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestObjectSuffixNanosUnique(t *testing.T) {
+	ts := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	format := KeyFormat{Suffix: suffixNanos}
+
+	// two partitions of a flush asking for keys in the same instant
+	keys := make(chan string, 2000)
+	var wg sync.WaitGroup
+	for _, tag := range []string{"app", "app"} {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				keys <- format.ObjectKey("logs", tag, ts, nil)
+			}
+		}(tag)
+	}
+	wg.Wait()
+	close(keys)
+
+	seen := make(map[string]bool)
+	for key := range keys {
+		if seen[key] {
+			t.Fatalf("ObjectKey() = %v twice, want distinct keys", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestPreviewObjectKey(t *testing.T) {
+	ts := time.Date(2024, 4, 1, 10, 30, 0, 0, time.FixedZone("JST", 9*60*60))
+	tests := []struct {
+		config map[string]string
+		tag    string
+		want   string
+	}{
+		{map[string]string{"Prefix": "logs"}, "app", "logs/app/2024/04/01/"},
+		{map[string]string{"prefix": "logs", "date_format": "2006-01-02"}, "app.web", "logs/app.web/2024-04-01/"},
+		{map[string]string{"Prefix": "logs", "Append_Mode": "On"}, "app", "logs/app/2024/04/01/10.log.gz"},
+		{map[string]string{"Prefix": "logs", "Object_Suffix": "sequence", "Writer_ID": "a"}, "app", "logs/app/2024/04/01/1711935000_"},
+		{map[string]string{"Prefix": "../logs"}, "app", "__/logs/app/2024/04/01/"},
+	}
+	for _, tt := range tests {
+		got, err := PreviewObjectKey(tt.config, tt.tag, ts, nil)
+		if err != nil {
+			t.Errorf("PreviewObjectKey(%v) = %v", tt.config, err)
+			continue
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("PreviewObjectKey(%v) = %v, want prefix %v", tt.config, got, tt.want)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(`{"msg":"a"}`))
+	got, err := PreviewObjectKey(map[string]string{"Prefix": "logs", "Dedupe_By_Content": "On"}, "app", ts, []byte(`{"msg":"a"}`))
+	if want := "logs/app/2024/04/01/" + hex.EncodeToString(sum[:]) + ".log.gz"; err != nil || got != want {
+		t.Errorf("PreviewObjectKey(Dedupe_By_Content) = %v, %v, want %v", got, err, want)
+	}
+
+	for _, config := range []map[string]string{
+		{},
+		{"Prefix": "logs", "Object_Suffix": "random"},
+		{"Prefix": "logs", "Date_Format": "daily"},
+	} {
+		if got, err := PreviewObjectKey(config, "app", ts, nil); err == nil {
+			t.Errorf("PreviewObjectKey(%v) = %v, want an error", config, got)
+		}
+	}
+}
+
+func TestPreviewObjectKeyKeepsSequence(t *testing.T) {
+	config := map[string]string{"Prefix": "logs", "Object_Suffix": "sequence"}
+	ts := time.Date(2024, 4, 1, 10, 30, 0, 0, time.UTC)
+	first, err := PreviewObjectKey(config, "app", ts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := PreviewObjectKey(config, "app", ts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("PreviewObjectKey() = %v then %v, want the same key", first, second)
+	}
+	if got := (KeyFormat{Suffix: suffixSequence}).ObjectKey("logs", "app", toJstTime(ts), nil); got != first {
+		t.Errorf("ObjectKey() = %v, want the previewed %v", got, first)
+	}
+}
+
+func TestPartitionGranularity(t *testing.T) {
+	ts := time.Date(2024, 4, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		granularity string
+		want        string
+	}{
+		{"", "logs/app/2024/04/01/1711967400_"},
+		{granularityDay, "logs/app/2024/04/01/1711967400_"},
+		{granularityHour, "logs/app/2024/04/01/10/1711967400_"},
+		{granularityMinute, "logs/app/2024/04/01/10/30/1711967400_"},
+	}
+	for _, tt := range tests {
+		got := KeyFormat{Granularity: tt.granularity}.ObjectKey("logs", "app", ts, nil)
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("ObjectKey() with %q = %v, want prefix %v", tt.granularity, got, tt.want)
+		}
+	}
+
+	if _, err := PreviewObjectKey(map[string]string{"Prefix": "logs", "Partition_Granularity": "week"}, "app", ts, nil); err == nil {
+		t.Error("PreviewObjectKey() = nil with an unknown granularity, want an error")
+	}
+}
+
+// orderedClient records the keys it writes, in write order
+type orderedClient struct {
+	keys []string
+}
+
+func (c *orderedClient) Write(bucket, object string, content io.Reader) error {
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		return err
+	}
+	c.keys = append(c.keys, object)
+	return nil
+}
+
+func TestLexicalOrdering(t *testing.T) {
+	client := &orderedClient{}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.KeyFormat.LexicalOrdering = true
+	ctx.SubpartitionByEventTime = true
+
+	// each flush holds older records than the previous one
+	eventTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := ctx.addRecord("app", []byte(`{"msg":"hello"}`), eventTime.Add(-time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sorted := append([]string{}, client.keys...)
+	sort.Strings(sorted)
+	for i := range sorted {
+		if sorted[i] != client.keys[i] {
+			t.Fatalf("sorted keys = %v, want the write order %v", sorted, client.keys)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps the Log_Level names to levels, event being the older
+// name of debug
+var logLevels = map[string]int{
+	"event": levelDebug,
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// levelNames are the [level] prefixes of logged messages
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+// parseLogLevel : the level of a Log_Level name, false when unknown
+func parseLogLevel(name string) (int, bool) {
+	level, ok := logLevels[strings.ToLower(strings.TrimSpace(name))]
+	return level, ok
+}
+
+// Logger writes the messages of a plugin instance at or above Level.
+// A nil Logger writes every message.
+type Logger struct {
+	Level int
+	// Limiter collapses repeated warnings and errors, nil writes them all
+	Limiter *LogLimiter
+	// Output writes a message, log.Print when nil
+	Output func(string)
+}
+
+// Debugf : log a debug message
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+// Infof : log an info message
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+// Warnf : log a warning, collapsed with its repeats by Limiter
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+// Errorf : log an error, collapsed with its repeats by Limiter
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+func (l *Logger) logf(level int, format string, args ...interface{}) {
+	msg := "[" + levelNames[level] + "] " + fmt.Sprintf(format, args...)
+	if l == nil {
+		log.Print(msg)
+		return
+	}
+	if level < l.Level {
+		return
+	}
+	if level < levelWarn || l.Limiter == nil {
+		l.output(msg)
+		return
+	}
+	for _, msg := range l.Limiter.filter(msg) {
+		l.output(msg)
+	}
+}
+
+func (l *Logger) output(msg string) {
+	if l.Output == nil {
+		log.Print(msg)
+		return
+	}
+	l.Output(msg)
+}
+
+// LogLimiter collapses identical messages logged within a window, so a GCS
+// outage logs each retry warning once per window instead of once per flush
+type LogLimiter struct {
+	Window time.Duration
+	// Output writes a message, log.Print when nil
+	Output func(string)
+
+	mu         sync.Mutex
+	last       string
+	since      time.Time
+	suppressed int
+}
+
+// NewLogLimiter : collapse identical messages logged within window
+func NewLogLimiter(window time.Duration) *LogLimiter {
+	return &LogLimiter{Window: window}
+}
+
+// Printf logs a message unless it repeats the previous one within the
+// window. The number of dropped repeats is logged with the next message
+// that gets through. Safe to call concurrently.
+func (l *LogLimiter) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if l == nil {
+		log.Print(msg)
+		return
+	}
+
+	for _, msg := range l.filter(msg) {
+		l.output(msg)
+	}
+}
+
+// filter : the messages to write for msg, none when it repeats the previous
+// one within the window
+func (l *LogLimiter) filter(msg string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if msg == l.last && now.Sub(l.since) < l.Window {
+		l.suppressed++
+		return nil
+	}
+	var msgs []string
+	if l.suppressed > 0 {
+		msgs = append(msgs, fmt.Sprintf("[warn] previous message repeated %d more times\n", l.suppressed))
+	}
+	l.last, l.since, l.suppressed = msg, now, 0
+	return append(msgs, msg)
+}
+
+func (l *LogLimiter) output(msg string) {
+	if l.Output == nil {
+		log.Print(msg)
+		return
+	}
+	l.Output(msg)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var lines []string
+	limiter := NewLogLimiter(time.Minute)
+	limiter.Output = func(msg string) { lines = append(lines, msg) }
+
+	for i := 0; i < 1000; i++ {
+		limiter.Printf("[warn] error sending message in GCS: %v\n", "service unavailable")
+	}
+	if len(lines) != 1 {
+		t.Fatalf("lines logged = %v, want %v", len(lines), 1)
+	}
+
+	limiter.Printf("[error] error flushing buffer of %s\n", "app")
+	if len(lines) != 3 || !strings.Contains(lines[1], "repeated 999 more times") {
+		t.Errorf("lines logged = %q, want the repeat count before the new message", lines)
+	}
+
+	limiter.since = time.Now().Add(-2 * time.Minute)
+	limiter.Printf("[error] error flushing buffer of %s\n", "app")
+	if len(lines) != 4 {
+		t.Errorf("lines logged = %v, want a repeat logged once the window passed", len(lines))
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var lines []string
+	level, ok := parseLogLevel("error")
+	if !ok {
+		t.Fatal("parseLogLevel(error) not ok")
+	}
+	logger := &Logger{Level: level, Output: func(msg string) { lines = append(lines, msg) }}
+
+	logger.Debugf("Flushing buffer %s, %v\n", "bucket", "app")
+	logger.Infof("dry run, not writing %d bytes\n", 10)
+	logger.Warnf("error sending message in GCS: %v\n", "unavailable")
+	logger.Errorf("error flushing buffer of %s\n", "app")
+
+	if len(lines) != 1 || lines[0] != "[error] error flushing buffer of app\n" {
+		t.Errorf("logged %q, want the error only", lines)
+	}
+
+	if _, ok := parseLogLevel("verbose"); ok {
+		t.Error("parseLogLevel(verbose) ok, want unknown")
+	}
+}
+
+func TestLoggerLimitsWarnings(t *testing.T) {
+	var lines []string
+	logger := &Logger{Limiter: NewLogLimiter(time.Minute), Output: func(msg string) { lines = append(lines, msg) }}
+
+	for i := 0; i < 3; i++ {
+		logger.Infof("Flushing buffer %s\n", "app")
+		logger.Warnf("error sending message in GCS: %v\n", "unavailable")
+	}
+	if len(lines) != 4 {
+		t.Errorf("logged %q, want every info and the warning once", lines)
+	}
+}
+
+func TestFlushLogsAtLevel(t *testing.T) {
+	for _, tt := range []struct {
+		level string
+		want  bool
+	}{
+		{"debug", true},
+		{"error", false},
+	} {
+		t.Run(tt.level, func(t *testing.T) {
+			var lines []string
+			ctx := newTestContext(newMockClient(), map[string]string{"bucket": "bucket", "prefix": "logs"})
+			level, _ := parseLogLevel(tt.level)
+			ctx.Logger = &Logger{Level: level, Output: func(msg string) { lines = append(lines, msg) }}
+
+			if err := ctx.addRecord("app", []byte(`{"message":"hello"}`), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if err := flushBuffer(ctx, "app"); err != nil {
+				t.Fatal(err)
+			}
+			logged := strings.Contains(strings.Join(lines, ""), "[debug] Flushing buffer bucket, app")
+			if logged != tt.want {
+				t.Errorf("flush logged %q, want the debug message logged %v", lines, tt.want)
+			}
+		})
+	}
+}
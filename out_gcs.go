@@ -2,11 +2,19 @@ package main
 
 import (
 	"C"
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"time"
 	"unsafe"
 
@@ -17,21 +25,172 @@ import (
 import (
 	"compress/gzip"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-type PluginContext struct {
+// TagBuffer holds the pending records of a single tag
+type TagBuffer struct {
 	Buffer            bytes.Buffer
 	CurrentBufferSize int
 	LastFlushTime     time.Time
-	Config            map[string]string
+	// Times holds the event time of each buffered line
+	Times []time.Time
+	// RetryingSince is when the buffer first failed to flush, zero when healthy
+	RetryingSince time.Time
+	// RetryAfter holds off flushing until the retry backoff, or the longer
+	// delay asked by a rate limited write, is over
+	RetryAfter time.Time
+	// RetryAttempts counts the failed flushes in a row, spacing out retries
+	RetryAttempts int
+	// RetrySize and RetryCount are the bytes and records of the failed flush,
+	// retried as they were ahead of the records buffered since
+	RetrySize  int
+	RetryCount int
+	// LastLine is the last record added with CollapseConsecutive, buffered
+	// as LastLineSize bytes once Repeats identical records are collapsed
+	LastLine     []byte
+	LastLineSize int
+	Repeats      int
+}
+
+type PluginContext struct {
+	Client     StorageClient
+	BufferSize int
+	Buffers    map[string]*TagBuffer
+	// MaxTotalBufferSize flushes the largest buffers once all tags hold more, 0 disables
+	MaxTotalBufferSize int
+	Config             map[string]string
+	Alerter            *Alerter
+	KeyFormat          KeyFormat
+	// CompactionHints lists small objects per partition, nil disables
+	CompactionHints *CompactionHints
+	// IssuedKeys counts the object keys handed out in the current flush
+	IssuedKeys map[string]int
+	// MaxRecordSize rejects longer records, 0 disables
+	MaxRecordSize int
+	// OversizedRecords counts the records rejected for MaxRecordSize
+	OversizedRecords int64
+	// AdaptiveBuffer lets retrying buffers grow up to MaxAdaptiveBufferSize
+	AdaptiveBuffer        bool
+	MaxAdaptiveBufferSize int
+	// FlushRecordCount flushes a buffer once it holds that many records, 0 disables
+	FlushRecordCount int
+	// SkipIfExists skips writing objects already written with the same size
+	SkipIfExists bool
+	// RecordSeparator ends every record, "\n" when empty
+	RecordSeparator []byte
+	// Logger writes the messages of the instance above Log_Level, nil logs them all
+	*Logger
+	// Routes send matching tags to their own bucket, first match wins
+	Routes []Route
+	// Backpressure refuses chunks with FLB_RETRY while the buffer of their
+	// tag is full and failing to flush, instead of buffering them
+	Backpressure bool
+	// Backoff spaces out the retries of failing buffers
+	Backoff Backoff
+	// BlockingRetry waits for the retry of an overflowing buffer before
+	// refusing a chunk, RetryStop cuts the wait short on exit
+	BlockingRetry bool
+	RetryStop     chan struct{}
+	// MaxRetryDuration dead-letters buffers retrying for longer, 0 retries forever
+	MaxRetryDuration time.Duration
+	// MaxInflightRetryBuffers spills the oldest retrying buffers beyond it to SpillDir, 0 disables
+	MaxInflightRetryBuffers int
+	SpillDir                string
+	Spilled                 []spilledBuffer
+	// MetadataFields are injected into each record, nil disables
+	MetadataFields *MetadataFields
+	// FieldFilter drops record fields before buffering, nil keeps all
+	FieldFilter *FieldFilter
+	// RenameFields renames top-level record keys before serialization
+	RenameFields []FieldRename
+	// MergeAllTags buffers every tag together under mergedTag
+	MergeAllTags bool
+	// PreCompressed buffers records holding gzip members as they are and
+	// writes them without compressing again
+	PreCompressed bool
+	// SkipEmptyRecords drops records left without fields before metadata is added
+	SkipEmptyRecords bool
+	// CollapseConsecutive buffers identical consecutive records once with a repeat count
+	CollapseConsecutive bool
+	// ObjectHeaderRecord writes a provenance record first in each object
+	ObjectHeaderRecord bool
+	// ReadAfterWrite reads every object back to check it was stored intact
+	ReadAfterWrite bool
+	// DryRun compresses and names objects but only logs their writes
+	DryRun bool
+	// TimeRangeMetadata sets the min and max record event time as object metadata
+	TimeRangeMetadata bool
+	// StorageClass of written objects, overridden per tag prefix by StorageClasses
+	StorageClass   string
+	StorageClasses map[string]string
+	// MaxObjectSize splits flushes whose compressed size exceeds it, 0 disables
+	MaxObjectSize int
+	// AppendMode appends each flush to an hourly object instead of writing a new one
+	AppendMode bool
+	// ParallelParts is the number of parts of a split flush written at once
+	ParallelParts int
+	// WatchdogTimeout reports writes running longer than it, 0 disables
+	WatchdogTimeout time.Duration
+	// WatchdogAbort gives up on writes caught by the watchdog
+	WatchdogAbort bool
+	// WriteSlots bounds the concurrent object writes, nil leaves them unbounded
+	WriteSlots chan struct{}
+	// StuckFlushes counts writes caught by the watchdog
+	StuckFlushes int64
+	// AbandonedWrites counts the writes given up on by the watchdog that
+	// are still running, each holding its slot of WriteSlots
+	AbandonedWrites int64
+	// VerificationFailures counts objects read back different from what was written
+	VerificationFailures int64
+	// CompressionLevel is the gzip level of flushed objects
+	CompressionLevel int
+	// CompressBufferSize batches compressed bytes into writes of this size, 0 disables
+	CompressBufferSize int
+	// SubpartitionByEventTime writes one object per minute of record event time
+	SubpartitionByEventTime bool
+	// PartitionTimeField names the record field partitioning objects by
+	// date, parsed with PartitionTimeFormat. Records without it use their event time.
+	PartitionTimeField  string
+	PartitionTimeFormat string
+	// Priorities maps tag prefixes to high or low priority
+	Priorities map[string]string
+	// FlushIntervals override the flush interval of matching tags, first match wins
+	FlushIntervals []FlushInterval
+	// MinCompressionRatio counts and logs flushes compressing worse than it, 0 disables
+	MinCompressionRatio  float64
+	LowCompressionEvents int64
+	// SizeBasedCompression uses gzip.BestSpeed for buffers below CompressionSizeThreshold
+	SizeBasedCompression     bool
+	CompressionSizeThreshold int
+	// Retries, LastFlush and LastError track flush outcomes for Status
+	Retries   int
+	LastFlush time.Time
+	LastError error
+	// SuccessCount, SuccessBytes, FailedCount and FailedBytes count object writes for Status
+	SuccessCount int64
+	SuccessBytes int64
+	FailedCount  int64
+	FailedBytes  int64
+	// AdminServer serves the configuration over HTTP, nil when disabled
+	AdminServer *http.Server
+	// HeartbeatStop stops the heartbeat task, nil when it is not running
+	HeartbeatStop chan struct{}
+	// CompactionThreshold is the size objects merged by the compactor stay below
+	CompactionThreshold int64
+	// CompactionQueue holds the directories for the compactor to list, nil
+	// when it is not running
+	CompactionQueue *CompactionQueue
+	// CompactorStop stops the compaction task, nil when it is not running
+	CompactorStop chan struct{}
 }
 
 var (
-	gcsClient  Client
-	err        error
-	bufferSize int
-	mutex      sync.Mutex
+	mutex sync.Mutex
+	// contexts are the initialized plugin instances, flushed on exit
+	contexts []*PluginContext
 )
 
 //export FLBPluginRegister
@@ -41,34 +200,238 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 
 //export FLBPluginInit
 func FLBPluginInit(plugin unsafe.Pointer) int {
-	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", output.FLBPluginConfigKey(plugin, "Credential"))
-	gcsClient, err = NewClient()
+	logger := &Logger{}
+	if name := output.FLBPluginConfigKey(plugin, "Log_Level"); name != "" {
+		if level, ok := parseLogLevel(name); ok {
+			logger.Level = level
+		} else {
+			logger.Warnf("Invalid log level: %s, logging everything\n", name)
+		}
+	}
+	credential := output.FLBPluginConfigKey(plugin, "Credential")
+	endpoint := output.FLBPluginConfigKey(plugin, "Gcs_Endpoint")
+	noAuth := parseBool(output.FLBPluginConfigKey(plugin, "Gcs_No_Auth"), false)
+	client, err := NewClient(credential, endpoint, noAuth)
 	if err != nil {
 		output.FLBPluginUnregister(plugin)
 		log.Fatal(err)
 		return output.FLB_ERROR
 	}
+	if contentType := output.FLBPluginConfigKey(plugin, "Content_Type"); contentType != "" {
+		client.ContentType = contentType
+	}
+	client.GzipContentEncoding = parseBool(output.FLBPluginConfigKey(plugin, "Set_Gzip_Content_Encoding"), true)
+	if chunkSize := output.FLBPluginConfigKey(plugin, "Upload_Chunk_Size_MB"); chunkSize != "" {
+		client.ChunkSize = parseInt(chunkSize, 16) * 1024 * 1024
+	}
+	client.ProjectID = output.FLBPluginConfigKey(plugin, "Project_ID")
+	client.Log = logger
+	client.MaxObjectBytes = int64(parseSizeValue(output.FLBPluginConfigKey(plugin, "Max_Single_Object_Bytes"), 1, defaultMaxObjectBytes))
+	if acl := output.FLBPluginConfigKey(plugin, "Predefined_Acl"); acl != "" {
+		if !predefinedACLs[acl] {
+			logger.Errorf("Invalid predefined ACL: %s\n", acl)
+			return output.FLB_ERROR
+		}
+		client.PredefinedACL = acl
+	}
 
-	bufferSizeStr := output.FLBPluginConfigKey(plugin, "Output_Buffer_Size")
-	bufferSize, err = strconv.Atoi(bufferSizeStr)
+	routes, err := parseTagRoutes(output.FLBPluginConfigKey(plugin, "Tag_Routes"))
 	if err != nil {
-		log.Printf("[error] Invalid buffer size value: %s, error: %v\n", bufferSizeStr, err)
+		logger.Errorf("%v\n", err)
 		return output.FLB_ERROR
 	}
+	for i := range routes {
+		routeClient, err := NewClient(routes[i].Credential, endpoint, noAuth)
+		if err != nil {
+			logger.Errorf("storage client of route %s: %v\n", routes[i].Match, err)
+			return output.FLB_ERROR
+		}
+		// routes share the object settings of the plugin client
+		shared := client
+		shared.GCS = routeClient.GCS
+		routes[i].Client = shared
+	}
+
+	bufferSize := parseBufferSize(output.FLBPluginConfigKey(plugin, "Output_Buffer_Size"))
+	autoCreateBucket := parseBool(output.FLBPluginConfigKey(plugin, "Auto_Create_Bucket"), false)
+	flushOnSignal := parseBool(output.FLBPluginConfigKey(plugin, "Flush_On_Signal"), false)
+	heartbeatInterval := time.Duration(parseInt(output.FLBPluginConfigKey(plugin, "Heartbeat_Interval_Sec"), 0)) * time.Second
+	compactionInterval := time.Duration(parseInt(output.FLBPluginConfigKey(plugin, "Compaction_Interval_Sec"), 0)) * time.Second
+	adminListen := output.FLBPluginConfigKey(plugin, "Admin_Listen")
 
 	cfg := map[string]string{
-		"region":  output.FLBPluginConfigKey(plugin, "Region"),
-		"bucket":  output.FLBPluginConfigKey(plugin, "Bucket"),
-		"prefix":  output.FLBPluginConfigKey(plugin, "Prefix"),
-		"jsonKey": output.FLBPluginConfigKey(plugin, "JSON_Key"),
+		"region":      output.FLBPluginConfigKey(plugin, "Region"),
+		"bucket":      output.FLBPluginConfigKey(plugin, "Bucket"),
+		"prefix":      output.FLBPluginConfigKey(plugin, "Prefix"),
+		"jsonKey":     output.FLBPluginConfigKey(plugin, "JSON_Key"),
+		"sortByField": output.FLBPluginConfigKey(plugin, "Sort_By_Field"),
+
+		"deadLetterPrefix": output.FLBPluginConfigKey(plugin, "Dead_Letter_Prefix"),
+		"credential":       credential,
+
+		// startup settings, only kept to be served by the admin server
+		"gcsEndpoint":        endpoint,
+		"gcsNoAuth":          strconv.FormatBool(noAuth),
+		"logLevel":           output.FLBPluginConfigKey(plugin, "Log_Level"),
+		"adminListen":        adminListen,
+		"autoCreateBucket":   strconv.FormatBool(autoCreateBucket),
+		"flushOnSignal":      strconv.FormatBool(flushOnSignal),
+		"heartbeatInterval":  heartbeatInterval.String(),
+		"compactionInterval": compactionInterval.String(),
 	}
 
 	pluginContext := &PluginContext{
-		LastFlushTime: time.Now(),
-		Config:        cfg,
+		Logger:     logger,
+		Client:     client,
+		BufferSize: bufferSize,
+		Buffers:    make(map[string]*TagBuffer),
+		Config:     cfg,
+		Routes:     routes,
+		KeyFormat: KeyFormat{
+			DateFormat:      output.FLBPluginConfigKey(plugin, "Date_Format"),
+			DedupeByContent: parseBool(output.FLBPluginConfigKey(plugin, "Dedupe_By_Content"), false),
+			WriterID:        output.FLBPluginConfigKey(plugin, "Writer_ID"),
+			Suffix:          strings.ToLower(output.FLBPluginConfigKey(plugin, "Object_Suffix")),
+			LexicalOrdering: parseBool(output.FLBPluginConfigKey(plugin, "Lexical_Ordering"), false),
+			Granularity:     strings.ToLower(output.FLBPluginConfigKey(plugin, "Partition_Granularity")),
+		},
+		AppendMode:      parseBool(output.FLBPluginConfigKey(plugin, "Append_Mode"), false),
+		MaxObjectSize:   parseSizeValue(output.FLBPluginConfigKey(plugin, "Max_Object_Size_MB"), 1024*1024, 0),
+		ParallelParts:   parseInt(output.FLBPluginConfigKey(plugin, "Parallel_Parts"), 1),
+		WatchdogTimeout: time.Duration(parseInt(output.FLBPluginConfigKey(plugin, "Watchdog_Timeout_Sec"), 0)) * time.Second,
+		WatchdogAbort:   parseBool(output.FLBPluginConfigKey(plugin, "Watchdog_Abort"), false),
+		ReadAfterWrite:  parseBool(output.FLBPluginConfigKey(plugin, "Read_After_Write"), false),
+		SkipIfExists:    parseBool(output.FLBPluginConfigKey(plugin, "Skip_If_Exists"), false),
+		DryRun:          parseBool(output.FLBPluginConfigKey(plugin, "Dry_Run"), false),
+
+		MaxTotalBufferSize: parseSizeValue(output.FLBPluginConfigKey(plugin, "Max_Total_Buffer_MB"), 1024*1024, 0),
+
+		ObjectHeaderRecord: parseBool(output.FLBPluginConfigKey(plugin, "Object_Header_Record"), false),
+		TimeRangeMetadata:  parseBool(output.FLBPluginConfigKey(plugin, "Time_Range_Metadata"), false),
+		MergeAllTags:       parseBool(output.FLBPluginConfigKey(plugin, "Merge_All_Tags"), false),
+
+		CollapseConsecutive: parseBool(output.FLBPluginConfigKey(plugin, "Collapse_Consecutive"), false),
+		SkipEmptyRecords:    parseBool(output.FLBPluginConfigKey(plugin, "Skip_Empty_Records"), false),
+
+		SubpartitionByEventTime: parseBool(output.FLBPluginConfigKey(plugin, "Subpartition_By_Event_Time"), false),
+		PartitionTimeField:      output.FLBPluginConfigKey(plugin, "Partition_Time_Field"),
+		PartitionTimeFormat:     output.FLBPluginConfigKey(plugin, "Partition_Time_Format"),
+
+		CompressionLevel:         parseInt(output.FLBPluginConfigKey(plugin, "Compression_Level"), gzip.DefaultCompression),
+		SizeBasedCompression:     parseBool(output.FLBPluginConfigKey(plugin, "Size_Based_Compression"), false),
+		CompressionSizeThreshold: parseInt(output.FLBPluginConfigKey(plugin, "Compression_Size_Threshold_KB"), 1024) * 1024,
+		CompressBufferSize:       parseInt(output.FLBPluginConfigKey(plugin, "Compress_Buffer_KB"), 0) * 1024,
+		MinCompressionRatio:      parseFloat(output.FLBPluginConfigKey(plugin, "Min_Compression_Ratio"), 0),
+	}
+	// appended flushes of an hour share a single object
+	pluginContext.KeyFormat.Hourly = pluginContext.AppendMode
+	if !validGranularity(pluginContext.KeyFormat.Granularity) {
+		pluginContext.Warnf("Invalid partition granularity: %s, using %s\n", pluginContext.KeyFormat.Granularity, granularityDay)
+		pluginContext.KeyFormat.Granularity = granularityDay
+	}
+	if pluginContext.KeyFormat.LexicalOrdering && (pluginContext.AppendMode || pluginContext.KeyFormat.DedupeByContent) {
+		pluginContext.Warnf("Lexical_Ordering has no effect with Append_Mode or Dedupe_By_Content\n")
+	}
+	if !validSuffix(pluginContext.KeyFormat.Suffix) {
+		pluginContext.Warnf("Invalid object suffix: %s, using %s\n", pluginContext.KeyFormat.Suffix, suffixUUID)
+		pluginContext.KeyFormat.Suffix = suffixUUID
+	}
+	if pluginContext.CompressionLevel < gzip.HuffmanOnly || pluginContext.CompressionLevel > gzip.BestCompression {
+		pluginContext.Warnf("Invalid compression level: %d, using default\n", pluginContext.CompressionLevel)
+		pluginContext.CompressionLevel = gzip.DefaultCompression
+	}
+	if parseBool(output.FLBPluginConfigKey(plugin, "Pre_Compressed"), false) {
+		// gzip members can't be parsed, split or rewritten
+		pluginContext.PreCompressed = true
+		pluginContext.CollapseConsecutive = false
+		pluginContext.SubpartitionByEventTime = false
+		pluginContext.PartitionTimeField = ""
+	}
+	pluginContext.Priorities = parsePriorityMap(output.FLBPluginConfigKey(plugin, "Priority_Map"))
+	pluginContext.FlushIntervals = parseFlushIntervals(output.FLBPluginConfigKey(plugin, "Tag_Flush_Intervals"))
+	pluginContext.StorageClass = parseStorageClass(output.FLBPluginConfigKey(plugin, "Storage_Class"))
+	pluginContext.StorageClasses = parseStorageClassMap(output.FLBPluginConfigKey(plugin, "Storage_Class_Map"))
+	if parseBool(output.FLBPluginConfigKey(plugin, "Add_Metadata_Fields"), false) {
+		pluginContext.MetadataFields = NewMetadataFields(
+			output.FLBPluginConfigKey(plugin, "Metadata_Tag_Key"),
+			output.FLBPluginConfigKey(plugin, "Metadata_Hostname_Key"),
+			output.FLBPluginConfigKey(plugin, "Metadata_Time_Key"),
+		)
+	}
+	pluginContext.FieldFilter = NewFieldFilter(
+		output.FLBPluginConfigKey(plugin, "Include_Fields"),
+		output.FLBPluginConfigKey(plugin, "Exclude_Fields"),
+	)
+	pluginContext.RenameFields = parseRenameFields(output.FLBPluginConfigKey(plugin, "Rename_Fields"))
+	switch policy := strings.ToLower(output.FLBPluginConfigKey(plugin, "Overflow_Policy")); policy {
+	case "", overflowBuffer:
+	case overflowBackpressure:
+		pluginContext.Backpressure = true
+	default:
+		pluginContext.Warnf("Invalid overflow policy: %s, using %s\n", policy, overflowBuffer)
+	}
+	pluginContext.Backoff = Backoff{
+		Strategy: parseBackoffStrategy(output.FLBPluginConfigKey(plugin, "Backoff_Strategy")),
+		Jitter:   parseBool(output.FLBPluginConfigKey(plugin, "Backoff_Jitter"), false),
+	}
+	if parseBool(output.FLBPluginConfigKey(plugin, "Blocking_Retry"), false) {
+		pluginContext.BlockingRetry = true
+		pluginContext.RetryStop = make(chan struct{})
+	}
+	pluginContext.MaxRetryDuration = time.Duration(parseInt(output.FLBPluginConfigKey(plugin, "Max_Retry_Duration_Sec"), 0)) * time.Second
+	pluginContext.MaxInflightRetryBuffers = parseInt(output.FLBPluginConfigKey(plugin, "Max_Inflight_Retry_Buffers"), 0)
+	pluginContext.SpillDir = output.FLBPluginConfigKey(plugin, "Spill_Dir")
+	if pluginContext.SpillDir == "" {
+		pluginContext.SpillDir = filepath.Join(os.TempDir(), "fluent-bit-go-gcs")
+	}
+	pluginContext.loadSpilled()
+	pluginContext.CompactionThreshold = int64(parseInt(output.FLBPluginConfigKey(plugin, "Compaction_Threshold_KB"), 1024)) * 1024
+	if parseBool(output.FLBPluginConfigKey(plugin, "Write_Compaction_Hint"), false) {
+		pluginContext.CompactionHints = NewCompactionHints(pluginContext.CompactionThreshold)
+	}
+	pluginContext.MaxRecordSize = parseSizeValue(output.FLBPluginConfigKey(plugin, "Max_Record_Size_Bytes"), 1, 0)
+	if limit := parseInt(output.FLBPluginConfigKey(plugin, "Max_Concurrent_Flushes"), 0); limit > 0 {
+		pluginContext.WriteSlots = make(chan struct{}, limit)
+	}
+	pluginContext.AdaptiveBuffer = parseBool(output.FLBPluginConfigKey(plugin, "Adaptive_Buffer"), false)
+	pluginContext.MaxAdaptiveBufferSize = parseSizeValue(output.FLBPluginConfigKey(plugin, "Max_Buffer_Size_MB"), 1024*1024, 4*bufferSize)
+	pluginContext.FlushRecordCount = parseInt(output.FLBPluginConfigKey(plugin, "Flush_Record_Count"), 0)
+	pluginContext.RecordSeparator = parseRecordSeparator(output.FLBPluginConfigKey(plugin, "Record_Separator"))
+	if window := parseInt(output.FLBPluginConfigKey(plugin, "Log_Dedupe_Window_Sec"), 0); window > 0 {
+		logger.Limiter = NewLogLimiter(time.Duration(window) * time.Second)
+	}
+	if webhookURL := output.FLBPluginConfigKey(plugin, "Alert_Webhook_URL"); webhookURL != "" {
+		pluginContext.Alerter = NewAlerter(
+			webhookURL,
+			parseInt(output.FLBPluginConfigKey(plugin, "Alert_Failure_Threshold"), 3),
+			time.Duration(parseInt(output.FLBPluginConfigKey(plugin, "Alert_Interval_Sec"), 300))*time.Second,
+		)
+	}
+	if autoCreateBucket {
+		if err := pluginContext.ensureBucket(); err != nil {
+			pluginContext.Errorf("error creating bucket %s: %v\n", cfg["bucket"], err)
+		}
+	}
+	if adminListen != "" {
+		if err := pluginContext.startAdminServer(adminListen); err != nil {
+			pluginContext.Warnf("error starting admin server on %s: %v\n", adminListen, err)
+		}
 	}
 	output.FLBPluginSetContext(plugin, pluginContext)
 
+	mutex.Lock()
+	contexts = append(contexts, pluginContext)
+	if heartbeatInterval > 0 {
+		pluginContext.startHeartbeat(heartbeatInterval)
+	}
+	if compactionInterval > 0 {
+		pluginContext.startCompactor(compactionInterval)
+	}
+	if flushOnSignal {
+		startSignalFlush()
+	}
+	mutex.Unlock()
+
 	return output.FLB_OK
 }
 
@@ -77,96 +440,1425 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	// Type assert context back into the original type for the Go variable
 	values := output.FLBPluginGetContext(ctx).(*PluginContext)
 
-	log.Printf("[event] Flush called %s, %v\n", values.Config["bucket"], C.GoString(tag))
+	tagName := C.GoString(tag)
+	values.Debugf("Flush called %s, %v\n", values.Config["bucket"], tagName)
 	dec := output.NewDecoder(data, int(length))
 
+	// Return options:
+	//
+	// output.FLB_OK    = data have been processed.
+	// output.FLB_ERROR = unrecoverable error, do not try this again.
+	// output.FLB_RETRY = retry to flush later
+	return values.flushChunk(tagName, func() (int, interface{}, map[interface{}]interface{}) {
+		return output.GetRecord(dec)
+	})
+}
+
+// recordIterator yields the records of a chunk like output.GetRecord, ret
+// is non-zero once they are all read
+type recordIterator func() (ret int, ts interface{}, record map[interface{}]interface{})
+
+// flushChunk : buffer the records of a chunk of tag, then flush the expired
+// buffers. Buffered records are retried by the plugin until written, so a
+// failed flush still returns FLB_OK: fluent-bit retrying the chunk as well
+// would buffer its records twice. Chunks are refused with FLB_RETRY while
+// the buffer of their tag overflows, with BlockingRetry once its retry
+// was waited for and failed again.
+func (p *PluginContext) flushChunk(tag string, next recordIterator) int {
+	mutex.Lock()
+	overflowing := p.overflowing(p.bufferTag(tag))
+	mutex.Unlock()
+	if overflowing && p.BlockingRetry && p.waitRetry(p.bufferTag(tag)) {
+		mutex.Lock()
+		overflowing = p.overflowing(p.bufferTag(tag))
+		mutex.Unlock()
+	}
+	if overflowing {
+		p.Warnf("buffer of %s full and failing to flush, asking fluent-bit to retry\n", tag)
+		return output.FLB_RETRY
+	}
+
 	for {
-		ret, _, record := output.GetRecord(dec)
+		ret, ts, record := next()
 		if ret != 0 {
 			break
 		}
 
-		line, err := createJSON(values.Config["jsonKey"], record)
+		timestamp := eventTime(ts)
+		line, err := p.encodeRecord(tag, timestamp, record)
 		if err != nil {
-			log.Printf("[warn] error creating message for GCS: %v\n", err)
+			p.Warnf("error creating message for GCS: %v\n", err)
 			continue
 		}
+		if line == nil {
+			continue
+		}
+		timestamp = p.partitionTime(line, timestamp)
 
 		mutex.Lock()
-		values.Buffer.Write(line)
-		values.Buffer.Write([]byte("\n"))
-		values.CurrentBufferSize += len(line) + 1
-
-		if values.CurrentBufferSize >= bufferSize {
-			if err := flushBuffer(values, C.GoString(tag)); err != nil {
-				mutex.Unlock()
-				return output.FLB_RETRY
-			}
+		if err := p.addRecord(p.bufferTag(tag), line, timestamp); errors.Is(err, errRecordTooLarge) {
+			p.Warnf("dropping record of %s: %v\n", tag, err)
+		} else if err != nil {
+			p.Warnf("keeping records of %s buffered for a retry: %v\n", tag, err)
 		}
 		mutex.Unlock()
 	}
 
 	mutex.Lock()
-	currentTime := time.Now()
-	if currentTime.Sub(values.LastFlushTime) >= time.Minute {
-		if err := flushBuffer(values, C.GoString(tag)); err != nil {
-			mutex.Unlock()
-			return output.FLB_RETRY
-		}
+	if err := p.flushExpired(time.Now()); err != nil {
+		p.Warnf("keeping expired buffers for a retry: %v\n", err)
 	}
 	mutex.Unlock()
-	// Return options:
-	//
-	// output.FLB_OK    = data have been processed.
-	// output.FLB_ERROR = unrecoverable error, do not try this again.
-	// output.FLB_RETRY = retry to flush later
 	return output.FLB_OK
 }
 
-func flushBuffer(values *PluginContext, tag string) error {
-	log.Printf("[event] Flushing buffer %s, %v\n", values.Config["bucket"], tag)
-	if values.Buffer.Len() > 0 {
-		var gzipBuffer bytes.Buffer
-		zw := gzip.NewWriter(&gzipBuffer)
-		defer zw.Close()
-
-		if _, err := zw.Write(values.Buffer.Bytes()); err != nil {
-			log.Printf("[warn] error compressing data: %v\n", err)
+// waitRetry : wait without holding mutex until the retry of the buffer of
+// tag is due, false when RetryStop cut the wait short
+func (p *PluginContext) waitRetry(tag string) bool {
+	mutex.Lock()
+	var retryAfter time.Time
+	if buf, ok := p.Buffers[tag]; ok {
+		retryAfter = buf.RetryAfter
+	}
+	stop := p.RetryStop
+	mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(retryAfter))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// stopBlockingRetries : end the waits of BlockingRetry. Must be called
+// with mutex held.
+func (p *PluginContext) stopBlockingRetries() {
+	if p.RetryStop != nil {
+		close(p.RetryStop)
+		p.RetryStop = nil
+	}
+}
+
+// Overflow_Policy values, what becomes of the chunks of a tag whose buffer
+// is full and failing to flush
+const (
+	overflowBuffer       = "buffer"
+	overflowBackpressure = "backpressure"
+)
+
+// overflowing : whether the buffer of tag is retrying and can take no more
+// records, trying once more when its retry is due
+func (p *PluginContext) overflowing(tag string) bool {
+	buf, ok := p.Buffers[tag]
+	if !ok || buf.RetryingSince.IsZero() || !p.overflowed(buf) {
+		return false
+	}
+	if time.Now().Before(buf.RetryAfter) {
+		return true
+	}
+	return flushBuffer(p, tag) != nil
+}
+
+// overflowed : whether the retrying buf is at its limit. With Backpressure
+// that is once it is full, otherwise once all buffers reach
+// MaxTotalBufferSize or, without it, buf reaches MaxAdaptiveBufferSize.
+func (p *PluginContext) overflowed(buf *TagBuffer) bool {
+	if p.Backpressure {
+		return p.full(buf)
+	}
+	if p.MaxTotalBufferSize > 0 {
+		total := 0
+		for _, b := range p.Buffers {
+			total += b.CurrentBufferSize
+		}
+		return total >= p.MaxTotalBufferSize
+	}
+	limit := p.MaxAdaptiveBufferSize
+	if limit < p.BufferSize {
+		limit = p.BufferSize
+	}
+	return buf.CurrentBufferSize >= limit
+}
+
+// mergedTag is the buffer holding every tag when MergeAllTags is set
+const mergedTag = "all"
+
+// bufferTag : the buffer receiving the records of tag
+func (p *PluginContext) bufferTag(tag string) string {
+	if p.MergeAllTags {
+		return mergedTag
+	}
+	return tag
+}
+
+// defaultRecordSeparator ends every record unless Record_Separator is set
+var defaultRecordSeparator = []byte("\n")
+
+// recordSeparator : the bytes ending every buffered record, none between
+// pre-compressed gzip members
+func (p *PluginContext) recordSeparator() []byte {
+	if p.PreCompressed {
+		return nil
+	}
+	if len(p.RecordSeparator) == 0 {
+		return defaultRecordSeparator
+	}
+	return p.RecordSeparator
+}
+
+// getBuffer : return the buffer of tag, creating it on first use
+func (p *PluginContext) getBuffer(tag string) *TagBuffer {
+	buf, ok := p.Buffers[tag]
+	if !ok {
+		buf = &TagBuffer{LastFlushTime: time.Now()}
+		p.Buffers[tag] = buf
+	}
+	return buf
+}
+
+// errRecordTooLarge rejects records longer than MaxRecordSize
+var errRecordTooLarge = errors.New("record above the maximum record size")
+
+// addRecord : append a line to the buffer of tag and flush it once full.
+// Lines longer than MaxRecordSize are counted and rejected with
+// errRecordTooLarge.
+func (p *PluginContext) addRecord(tag string, line []byte, timestamp time.Time) error {
+	if p.MaxRecordSize > 0 && len(line) > p.MaxRecordSize {
+		p.OversizedRecords++
+		return fmt.Errorf("%w: %d bytes", errRecordTooLarge, len(line))
+	}
+	buf := p.getBuffer(tag)
+	if p.CollapseConsecutive && buf.Repeats > 0 && bytes.Equal(line, buf.LastLine) {
+		buf.collapseRepeat(p.recordSeparator())
+	} else {
+		sep := p.recordSeparator()
+		buf.Buffer.Write(line)
+		buf.Buffer.Write(sep)
+		buf.CurrentBufferSize += len(line) + len(sep)
+		buf.Times = append(buf.Times, timestamp)
+		if p.CollapseConsecutive {
+			buf.LastLine, buf.LastLineSize, buf.Repeats = line, len(line)+len(sep), 1
+		}
+	}
+
+	// until its retry is due the buffer keeps growing past its size
+	if p.full(buf) && !time.Now().Before(buf.RetryAfter) {
+		return flushBuffer(p, tag)
+	}
+	return p.enforceMaxTotalBufferSize()
+}
+
+// full : whether buf holds BufferSize bytes or FlushRecordCount records.
+// With AdaptiveBuffer, a retrying buffer grows up to MaxAdaptiveBufferSize
+// before its size triggers another attempt.
+func (p *PluginContext) full(buf *TagBuffer) bool {
+	if p.FlushRecordCount > 0 && len(buf.Times) >= p.FlushRecordCount {
+		return true
+	}
+	limit := p.BufferSize
+	if p.AdaptiveBuffer && !buf.RetryingSince.IsZero() && p.MaxAdaptiveBufferSize > limit {
+		limit = p.MaxAdaptiveBufferSize
+	}
+	return buf.CurrentBufferSize >= limit
+}
+
+// enforceMaxTotalBufferSize : flush the largest buffers until the buffers of
+// all tags together fit in MaxTotalBufferSize
+func (p *PluginContext) enforceMaxTotalBufferSize() error {
+	if p.MaxTotalBufferSize <= 0 {
+		return nil
+	}
+
+	for {
+		total := 0
+		largestTag := ""
+		largestSize := 0
+		now := time.Now()
+		for tag, buf := range p.Buffers {
+			total += buf.CurrentBufferSize
+			if buf.CurrentBufferSize > largestSize && !now.Before(buf.RetryAfter) {
+				largestTag, largestSize = tag, buf.CurrentBufferSize
+			}
+		}
+		if total <= p.MaxTotalBufferSize || largestSize == 0 {
+			return nil
+		}
+
+		p.Infof("%d bytes buffered over Max_Total_Buffer_MB, flushing %s\n", total, largestTag)
+		if err := flushBuffer(p, largestTag); err != nil {
 			return err
 		}
-		if err := zw.Close(); err != nil {
-			log.Printf("[warn] error closing gzip writer: %v\n", err)
+	}
+}
+
+// flushExpired : flush every tag buffer not flushed within its flush
+// interval whose retry is due, carrying on past failures
+func (p *PluginContext) flushExpired(now time.Time) error {
+	p.retrySpilled(now)
+	defer p.writeCompactionHints(now, false)
+	var errs []error
+	for tag, buf := range p.Buffers {
+		if now.Before(buf.RetryAfter) {
+			continue
+		}
+		if now.Sub(buf.LastFlushTime) >= p.flushInterval(tag) {
+			if err := flushBuffer(p, tag); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", tag, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushAll : flush every tag buffer, carrying on past failures
+func (p *PluginContext) flushAll() {
+	p.retrySpilled(time.Now())
+	for tag := range p.Buffers {
+		if err := flushBuffer(p, tag); err != nil {
+			p.Errorf("error flushing buffer of %s: %v\n", tag, err)
+		}
+	}
+	p.writeCompactionHints(time.Now(), true)
+}
+
+func flushBuffer(values *PluginContext, tag string) error {
+	values.Debugf("Flushing buffer %s, %v\n", values.Config["bucket"], tag)
+	buf := values.getBuffer(tag)
+	for buf.Buffer.Len() > 0 {
+		if err := values.flushRecords(tag, buf); err != nil {
+			values.markRetrying(tag)
 			return err
 		}
+	}
+	return nil
+}
+
+// flushRecords : write the records of buf, or those of its failed flush
+// alone when retrying so the retried objects keep the same content and
+// Dedupe_By_Content names
+func (p *PluginContext) flushRecords(tag string, buf *TagBuffer) error {
+	size, count := buf.Buffer.Len(), len(buf.Times)
+	if buf.RetrySize > 0 {
+		size, count = buf.RetrySize, buf.RetryCount
+	}
+	data, times := buf.Buffer.Bytes()[:size], buf.Times[:count]
+	p.IssuedKeys = make(map[string]int)
+	batches := []batch{{data: data, time: getCurrentJstTime(), times: times}}
+	if p.SubpartitionByEventTime {
+		batches = splitByMinute(data, p.recordSeparator(), times)
+	} else if p.PartitionTimeField != "" {
+		batches = splitByPartition(data, p.recordSeparator(), times, p.KeyFormat.partitionFormat())
+	}
+
+	var err error
+	for i, b := range batches {
+		if err = p.flushBatch(tag, b); err != nil {
+			// batches already written are left out of the retry or dead letter
+			if i > 0 {
+				data, times = joinBatches(batches[i:])
+				buf.replace(size, count, data, times)
+				size, count = len(data), len(times)
+			}
+			if isRetryable(err) && !p.retryExpired(buf) {
+				// keep the buffer so the next flush retries it
+				buf.RetrySize, buf.RetryCount = size, count
+				// a repeat of the last record must not rewrite it
+				buf.Repeats = 0
+				if buf.RetryingSince.IsZero() {
+					buf.RetryingSince = time.Now()
+				}
+				buf.RetryAttempts++
+				delay := p.Backoff.Delay(buf.RetryAttempts)
+				if asked := retryAfter(err); asked > delay {
+					delay = asked
+				}
+				buf.RetryAfter = time.Now().Add(delay)
+				p.recordFlush(err)
+				return err
+			}
+			p.deadLetter(tag, data)
+			break
+		}
+	}
+	p.recordFlush(err)
+	buf.drop(size, count)
+	return nil
+}
+
+// joinBatches : the records and event times of batches, in order
+func joinBatches(batches []batch) ([]byte, []time.Time) {
+	var data []byte
+	var times []time.Time
+	for _, b := range batches {
+		data = append(data, b.data...)
+		times = append(times, b.times...)
+	}
+	return data, times
+}
+
+// replace : swap the first size bytes and count records of the buffer for
+// data and times
+func (b *TagBuffer) replace(size, count int, data []byte, times []time.Time) {
+	content := append(append([]byte{}, data...), b.Buffer.Bytes()[size:]...)
+	b.Buffer.Reset()
+	b.Buffer.Write(content)
+	b.CurrentBufferSize = len(content)
+	b.Times = append(append([]time.Time{}, times...), b.Times[count:]...)
+}
+
+// drop : remove the first size bytes and count records of the buffer once
+// they are written or given up on
+func (b *TagBuffer) drop(size, count int) {
+	b.Buffer.Next(size)
+	b.CurrentBufferSize -= size
+	b.Times = append(b.Times[:0], b.Times[count:]...)
+	if b.Buffer.Len() == 0 {
+		b.Repeats = 0
+	}
+	b.LastFlushTime = time.Now()
+	b.RetrySize, b.RetryCount = 0, 0
+	b.RetryingSince = time.Time{}
+	b.RetryAfter = time.Time{}
+	b.RetryAttempts = 0
+}
+
+// retryExpired : whether buf has been retrying for longer than MaxRetryDuration
+func (p *PluginContext) retryExpired(buf *TagBuffer) bool {
+	if p.MaxRetryDuration <= 0 || buf.RetryingSince.IsZero() {
+		return false
+	}
+	if time.Since(buf.RetryingSince) < p.MaxRetryDuration {
+		return false
+	}
+	p.Warnf("giving up on a buffer retrying since %v\n", buf.RetryingSince)
+	return true
+}
+
+// deadLetter : make a single attempt at saving data under the dead letter
+// prefix before the buffer holding it is dropped
+func (p *PluginContext) deadLetter(tag string, data []byte) {
+	prefix := p.Config["deadLetterPrefix"]
+	if prefix == "" {
+		p.Errorf("dropping %d bytes of %s after a non-retryable error\n", len(data), tag)
+		return
+	}
+
+	// dead letters are never appended, each gets its own object
+	format := p.KeyFormat
+	format.Hourly = false
+	objectKey := format.ObjectKey(prefix, tag, getCurrentJstTime(), data)
+	content := compressStream(data, p.CompressionLevel, p.CompressBufferSize)
+	defer content.Close()
+	if err := p.writeObject(p.destination(tag), objectKey, content, WriteOptions{StorageClass: p.storageClass(tag)}); err != nil {
+		p.Errorf("dropping %d bytes of %s, dead letter write failed: %v\n", len(data), tag, err)
+		return
+	}
+	p.Warnf("saved %d bytes of %s to dead letter object %s\n", len(data), tag, objectKey)
+}
+
+// batch is a run of newline-delimited records written to a single object
+type batch struct {
+	data []byte
+	// time partitions the object key
+	time time.Time
+	// times holds the event time of each record, empty when unknown
+	times []time.Time
+}
+
+// timeRange : oldest and newest record event time of b
+func (b batch) timeRange() (oldest, newest time.Time, ok bool) {
+	for _, t := range b.times {
+		if !ok || t.Before(oldest) {
+			oldest = t
+		}
+		if !ok || t.After(newest) {
+			newest = t
+		}
+		ok = true
+	}
+	return oldest, newest, ok
+}
+
+// objectHeader is the provenance record written first in objects when
+// Object_Header_Record is on, told apart from records by "_meta": true
+type objectHeader struct {
+	Meta          bool   `json:"_meta"`
+	Tag           string `json:"tag"`
+	Host          string `json:"host"`
+	Records       int    `json:"records"`
+	MinTime       string `json:"min_time,omitempty"`
+	MaxTime       string `json:"max_time,omitempty"`
+	PluginVersion string `json:"plugin_version"`
+}
+
+// withHeader : prepend the provenance record of b to data, records
+// separated by sep
+func withHeader(tag string, b batch, data, sep []byte) []byte {
+	host, _ := os.Hostname()
+	header := objectHeader{
+		Meta:          true,
+		Tag:           tag,
+		Host:          host,
+		Records:       bytes.Count(data, sep),
+		PluginVersion: pluginVersion(),
+	}
+	if oldest, newest, ok := b.timeRange(); ok {
+		header.MinTime = oldest.Format(time.RFC3339Nano)
+		header.MaxTime = newest.Format(time.RFC3339Nano)
+	}
+
+	line, err := jsoniter.Marshal(header)
+	if err != nil {
+		log.Printf("[warn] error encoding object header: %v\n", err)
+		return data
+	}
+	return append(append(line, sep...), data...)
+}
+
+// pluginVersion : module version the plugin was built from
+func pluginVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// flushBatch : compress and write the records of b under a key partitioned by its time
+func (p *PluginContext) flushBatch(tag string, b batch) error {
+	if p.PreCompressed {
+		// the buffered gzip members concatenated are the object
+		objectKey := p.objectKey(tag, b.time, b.data)
+		if p.AppendMode {
+			return p.appendUpload(tag, objectKey, bytes.NewReader(b.data), p.writeOptions(tag, b))
+		}
+		return p.upload(tag, objectKey, bytes.NewReader(b.data), p.writeOptions(tag, b))
+	}
+
+	data := b.data
+	if field := p.Config["sortByField"]; field != "" {
+		data = sortLines(data, field, p.recordSeparator())
+	}
+	if p.ObjectHeaderRecord {
+		// with Max_Object_Size_MB the header lands in the first part only
+		data = withHeader(tag, b, data, p.recordSeparator())
+	}
+
+	objectKey := p.objectKey(tag, b.time, data)
+	opts := p.writeOptions(tag, b)
+	if p.MaxObjectSize > 0 && !p.AppendMode {
+		return p.uploadParts(tag, objectKey, data, opts)
+	}
+	content := compressStream(data, p.compressionLevel(tag, len(data)), p.CompressBufferSize)
+	defer content.Close()
+	compressed := &countingReader{r: content}
+
+	var err error
+	if p.AppendMode {
+		err = p.appendUpload(tag, objectKey, compressed, opts)
+	} else {
+		err = p.upload(tag, objectKey, compressed, opts)
+	}
+	if err == nil {
+		p.checkCompressionRatio(tag, len(data), compressed.n)
+	}
+	return err
+}
+
+// objectKey : the key of an object of tag holding data, numbered when it
+// repeats a key issued earlier in the flush, as batches of identical content
+// do with DedupeByContent. Batches share the hourly object of Append_Mode,
+// each appended to it.
+func (p *PluginContext) objectKey(tag string, t time.Time, data []byte) string {
+	key := p.KeyFormat.ObjectKey(p.destination(tag).prefix, tag, t, data)
+	if p.KeyFormat.Hourly || p.IssuedKeys == nil {
+		return key
+	}
+
+	unique := key
+	for n := 2; p.IssuedKeys[unique] > 0; n++ {
+		unique = repeatObjectKey(key, n)
+	}
+	p.IssuedKeys[unique]++
+	return unique
+}
+
+// checkCompressionRatio : warn when data of tag compressed worse than
+// MinCompressionRatio, which hints at binary or already compressed records
+func (p *PluginContext) checkCompressionRatio(tag string, size int, compressed int64) {
+	if p.MinCompressionRatio <= 0 || compressed == 0 {
+		return
+	}
+	ratio := float64(size) / float64(compressed)
+	if ratio < p.MinCompressionRatio {
+		p.LowCompressionEvents++
+		p.Warnf("%s compressed %d bytes to %d, ratio %.2f below %.2f\n", tag, size, compressed, ratio, p.MinCompressionRatio)
+	}
+}
+
+// writeOptions : the attributes set on the objects of b
+func (p *PluginContext) writeOptions(tag string, b batch) WriteOptions {
+	opts := WriteOptions{StorageClass: p.storageClass(tag)}
+	if !p.TimeRangeMetadata {
+		return opts
+	}
+	if oldest, newest, ok := b.timeRange(); ok {
+		opts.Metadata = map[string]string{
+			"min-timestamp": oldest.Format(time.RFC3339Nano),
+			"max-timestamp": newest.Format(time.RFC3339Nano),
+		}
+	}
+	return opts
+}
+
+// mergeMetadata : the metadata of an object merged from objects with
+// metadata from and added, the time range covering both
+func mergeMetadata(from, added map[string]string) map[string]string {
+	if from == nil {
+		return added
+	}
+	merged := make(map[string]string, len(from)+len(added))
+	for k, v := range from {
+		merged[k] = v
+	}
+	for k, v := range added {
+		merged[k] = v
+	}
+	for key, earliest := range map[string]bool{"min-timestamp": true, "max-timestamp": false} {
+		old, err := time.Parse(time.RFC3339Nano, from[key])
+		if err != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, added[key]); err == nil && t.Before(old) != earliest {
+			merged[key] = from[key]
+		}
+	}
+	return merged
+}
+
+// storageClass : storage class of tag from the longest matching
+// Storage_Class_Map prefix, StorageClass otherwise
+func (p *PluginContext) storageClass(tag string) string {
+	match, class := -1, p.StorageClass
+	for prefix, value := range p.StorageClasses {
+		if strings.HasPrefix(tag, prefix) && len(prefix) > match {
+			match, class = len(prefix), value
+		}
+	}
+	return class
+}
+
+// splitByPartition : group lines by the partition segments their record
+// time renders to with layout, oldest partition first
+func splitByPartition(data, sep []byte, times []time.Time, layout string) []batch {
+	return groupLines(data, sep, times, func(t time.Time) (string, time.Time) {
+		jst := toJstTime(t)
+		return jst.Format(layout), jst
+	})
+}
+
+// splitByMinute : group lines by the minute of their event time, oldest minute first
+func splitByMinute(data, sep []byte, times []time.Time) []batch {
+	return groupLines(data, sep, times, func(t time.Time) (string, time.Time) {
+		minute := toJstTime(t).Truncate(time.Minute)
+		return strconv.FormatInt(minute.Unix(), 10), minute
+	})
+}
+
+// groupLines : group lines separated by sep into batches by the partition
+// of their time, each batch timed by its first line, oldest batch first
+func groupLines(data, sep []byte, times []time.Time, partition func(time.Time) (string, time.Time)) []batch {
+	lines := bytes.SplitAfter(data, sep)
+	groups := make(map[string]*batch)
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		t := time.Now()
+		if i < len(times) {
+			t = times[i]
+		}
+		key, partitionTime := partition(t)
+		g, ok := groups[key]
+		if !ok {
+			g = &batch{time: partitionTime}
+			groups[key] = g
+		}
+		g.data = append(g.data, line...)
+		g.times = append(g.times, t)
+	}
+
+	batches := make([]batch, 0, len(groups))
+	for _, g := range groups {
+		batches = append(batches, *g)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].time.Before(batches[j].time)
+	})
+	return batches
+}
+
+// upload : write one compressed object, reporting the outcome to the alerter
+func (p *PluginContext) upload(tag, objectKey string, content io.Reader, opts WriteOptions) error {
+	size, err := p.put(p.destination(tag), objectKey, content, opts)
+	return p.recordUpload(tag, objectKey, size, err)
+}
+
+// put : write an object to dst and check it when ReadAfterWrite is set,
+// returning its size. Safe to call concurrently.
+func (p *PluginContext) put(dst destination, objectKey string, content io.Reader, opts WriteOptions) (int64, error) {
+	if p.SkipIfExists && !p.DryRun {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return 0, err
+		}
+		if p.objectExists(dst, objectKey, int64(len(data))) {
+			p.Infof("%s/%s already written, skipping\n", dst.bucket, objectKey)
+			return int64(len(data)), nil
+		}
+		content = bytes.NewReader(data)
+	}
+
+	checksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	counter := &countingReader{r: io.TeeReader(content, checksum)}
+	err := p.writeObject(dst, objectKey, counter, opts)
+	if err == nil && p.ReadAfterWrite && !p.DryRun {
+		err = p.verifyObject(dst, objectKey, counter.n, checksum.Sum32())
+	}
+	return counter.n, err
+}
+
+// objectExists : whether objectKey was already written to dst with size
+// bytes, as when the ack of a successful write was lost. Lookup errors
+// count as missing, so the object is written again.
+func (p *PluginContext) objectExists(dst destination, objectKey string, size int64) bool {
+	checker, ok := dst.client.(ObjectChecker)
+	if !ok {
+		return false
+	}
+	exists, existing, err := checker.Exists(dst.bucket, objectKey)
+	if err != nil {
+		p.Warnf("error looking up %s/%s: %v\n", dst.bucket, objectKey, err)
+		return false
+	}
+	return exists && existing == size
+}
+
+// recordUpload : report the outcome of writing objectKey to the alerter and
+// compaction hints
+func (p *PluginContext) recordUpload(tag, objectKey string, size int64, err error) error {
+	if err != nil {
+		p.Warnf("error sending message in GCS: %v\n", err)
+		p.FailedCount++
+		p.FailedBytes += size
+		p.Alerter.RecordFailure(p.destination(tag).bucket, tag, err)
+		return err
+	}
+	p.SuccessCount++
+	p.SuccessBytes += size
+	p.Alerter.RecordSuccess()
+
+	p.CompactionHints.Record(tag, objectKey, size, time.Now())
+	if size < p.CompactionThreshold {
+		p.CompactionQueue.Record(p.destination(tag).bucket, objectKey, time.Now())
+	}
+	return nil
+}
+
+// appendUpload : write content as a new gzip member, then append it to the
+// hourly object. Readers decompress the concatenated members as one stream.
+func (p *PluginContext) appendUpload(tag, objectKey string, content io.Reader, opts WriteOptions) error {
+	dst := p.destination(tag)
+	appender, ok := dst.client.(ObjectAppender)
+	if !ok {
+		return fmt.Errorf("storage client can't append to %s", objectKey)
+	}
+
+	member := fmt.Sprintf("%s.member_%s", objectKey, uuid.Must(uuid.NewRandom()).String())
+	size, err := p.put(dst, member, content, opts)
+	if err == nil && !p.DryRun {
+		objectKey, err = appender.Append(dst.bucket, objectKey, member, opts)
+	}
+	return p.recordUpload(tag, objectKey, size, err)
+}
+
+// verifyObject : read a written object back and compare its size and CRC32C
+// with what was sent, so a silently corrupted write is retried
+func (p *PluginContext) verifyObject(dst destination, objectKey string, size int64, sum uint32) error {
+	reader, ok := dst.client.(ObjectReader)
+	if !ok {
+		p.Warnf("storage client can't read objects back, skipping verification of %s\n", objectKey)
+		return nil
+	}
+
+	rc, err := reader.Read(dst.bucket, objectKey)
+	if err != nil {
+		return fmt.Errorf("read after write of %s: %w", objectKey, err)
+	}
+	defer rc.Close()
+
+	checksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.Copy(checksum, rc)
+	if err != nil {
+		return fmt.Errorf("read after write of %s: %w", objectKey, err)
+	}
+	if n != size || checksum.Sum32() != sum {
+		atomic.AddInt64(&p.VerificationFailures, 1)
+		// the retry writes a new object, the corrupt one must not stay beside it
+		p.discardObjects(dst, []string{objectKey})
+		return fmt.Errorf("read after write of %s: got %d bytes crc32c %08x, want %d bytes crc32c %08x", objectKey, n, checksum.Sum32(), size, sum)
+	}
+	return nil
+}
+
+// ensureBucket : create the bucket in the configured region when it doesn't exist
+func (p *PluginContext) ensureBucket() error {
+	creator, ok := p.Client.(BucketCreator)
+	if !ok {
+		p.Warnf("storage client can't create buckets, skipping Auto_Create_Bucket\n")
+		return nil
+	}
+
+	bucket := p.Config["bucket"]
+	exists, err := creator.BucketExists(bucket)
+	if err != nil || exists {
+		return err
+	}
+	p.Infof("bucket %s doesn't exist, creating it in %s\n", bucket, p.Config["region"])
+	return creator.CreateBucket(bucket, p.Config["region"])
+}
+
+// writeCompactionHints : write the compaction hint files due at now, all
+// the changed ones when final is set. A failure only loses the hint until
+// the next write, so it is logged and ignored.
+func (p *PluginContext) writeCompactionHints(now time.Time, final bool) {
+	for _, file := range p.CompactionHints.Due(now, final) {
+		dst := p.destination(file.Tag)
+		if !p.CompactionHints.Loaded(file.Partition) {
+			p.CompactionHints.Load(file.Partition, p.readCompactionHint(dst, file.Key))
+		}
+		hint, err := p.CompactionHints.Hint(file.Partition)
+		if err != nil {
+			p.Warnf("error encoding compaction hint %s: %v\n", file.Key, err)
+			continue
+		}
+		content, err := compress(hint, p.CompressionLevel)
+		if err != nil {
+			p.Warnf("error compressing compaction hint: %v\n", err)
+			continue
+		}
+		if err := p.writeObject(dst, file.Key, content, WriteOptions{}); err != nil {
+			p.Warnf("error writing compaction hint %s: %v\n", file.Key, err)
+			continue
+		}
+		p.CompactionHints.Written(file.Partition, now)
+	}
+}
 
-		objectKey := GenerateObjectKey(values.Config["prefix"], tag, getCurrentJstTime())
-		if err = gcsClient.Write(values.Config["bucket"], objectKey, &gzipBuffer); err != nil {
-			log.Printf("[warn] error sending message in GCS: %v\n", err)
+// readCompactionHint : the hint file already stored under hintKey, nil when
+// it is missing, unreadable or the client can't read objects
+func (p *PluginContext) readCompactionHint(dst destination, hintKey string) []byte {
+	reader, ok := dst.client.(ObjectReader)
+	if !ok || p.DryRun {
+		return nil
+	}
+	rc, err := reader.Read(dst.bucket, hintKey)
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil
+	}
+	hint, err := io.ReadAll(zr)
+	if err != nil {
+		return nil
+	}
+	return hint
+}
+
+// uploadParts : write data as part objects each below MaxObjectSize, every
+// part carrying the attributes of the whole batch
+func (p *PluginContext) uploadParts(tag, objectKey string, data []byte, opts WriteOptions) error {
+	parts, err := compressParts(data, p.recordSeparator(), p.MaxObjectSize, p.compressionLevel(tag, len(data)))
+	if err != nil {
+		p.Warnf("error compressing data: %v\n", err)
+		return err
+	}
+
+	keys := make([]string, len(parts))
+	for i := range parts {
+		keys[i] = objectKey
+		if len(parts) > 1 {
+			keys[i] = partObjectKey(objectKey, i)
 		}
+	}
+	var compressed int64
+	for _, part := range parts {
+		compressed += int64(part.Len())
+	}
+	p.checkCompressionRatio(tag, len(data), compressed)
 
-		values.Buffer.Reset()
-		values.CurrentBufferSize = 0
-		values.LastFlushTime = time.Now()
+	if p.ParallelParts > 1 && len(parts) > 1 {
+		return p.uploadPartsParallel(tag, keys, parts, opts)
+	}
+
+	dst := p.destination(tag)
+	sizes := make([]int64, len(parts))
+	for i, part := range parts {
+		if sizes[i], err = p.put(dst, keys[i], part, opts); err != nil {
+			p.discardObjects(dst, keys[:i])
+			return p.recordUpload(tag, keys[i], sizes[i], err)
+		}
+	}
+	for i := range parts {
+		p.recordUpload(tag, keys[i], sizes[i], nil)
 	}
 	return nil
 }
 
+// uploadPartsParallel : write parts with up to ParallelParts concurrent
+// writes. Any failed part fails the whole flush and the parts written are
+// discarded, as the retry writes every part again.
+func (p *PluginContext) uploadPartsParallel(tag string, keys []string, parts []*bytes.Buffer, opts WriteOptions) error {
+	sizes := make([]int64, len(parts))
+	errs := make([]error, len(parts))
+	dst := p.destination(tag)
+	workers := make(chan struct{}, p.ParallelParts)
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, part *bytes.Buffer) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			sizes[i], errs[i] = p.put(dst, keys[i], part, opts)
+		}(i, part)
+	}
+	wg.Wait()
+
+	var written []string
+	failed := false
+	for i := range parts {
+		if errs[i] == nil {
+			written = append(written, keys[i])
+		} else {
+			failed = true
+		}
+	}
+	if failed {
+		p.discardObjects(dst, written)
+	}
+
+	// the alerter and compaction hints are only updated from this goroutine
+	var firstErr error
+	for i := range parts {
+		if failed && errs[i] == nil {
+			continue
+		}
+		if err := p.recordUpload(tag, keys[i], sizes[i], errs[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// discardObjects : delete the objects written by a failed flush, so its
+// retry doesn't store their records twice
+func (p *PluginContext) discardObjects(dst destination, keys []string) {
+	if len(keys) == 0 || p.DryRun {
+		return
+	}
+	deleter, ok := dst.client.(ObjectDeleter)
+	if !ok {
+		p.Warnf("storage client can't delete objects, %d objects of a failed flush are left behind\n", len(keys))
+		return
+	}
+	for _, key := range keys {
+		if err := deleter.Delete(dst.bucket, key); err != nil {
+			p.Warnf("error deleting %s/%s of a failed flush: %v\n", dst.bucket, key, err)
+		}
+	}
+}
+
+// writeObject : write an object to GCS under the watch of the stuck flush
+// watchdog. opts are dropped by backends that can't apply them.
+func (p *PluginContext) writeObject(dst destination, object string, content io.Reader, opts WriteOptions) error {
+	if p.DryRun {
+		n, err := io.Copy(io.Discard, content)
+		p.Infof("dry run, not writing %d bytes to %s/%s\n", n, dst.bucket, object)
+		return err
+	}
+
+	// a slot is held until the write returns, even one abandoned by the watchdog
+	if err := p.acquireWriteSlot(dst, object); err != nil {
+		return err
+	}
+	client := dst.client
+	write := func() error {
+		if p.WriteSlots != nil {
+			defer func() { <-p.WriteSlots }()
+		}
+		if writer, ok := client.(OptionsWriter); ok && !opts.empty() {
+			return writer.WriteWithOptions(dst.bucket, object, content, opts)
+		}
+		return client.Write(dst.bucket, object, content)
+	}
+	if p.WatchdogTimeout <= 0 {
+		return write()
+	}
+
+	// abandoned moves from 0 to 1 when the watchdog gives up on the write,
+	// or to 2 when the write returns first
+	var abandoned int32
+	done := make(chan error, 1)
+	go func() {
+		err := write()
+		if !atomic.CompareAndSwapInt32(&abandoned, 0, 2) {
+			atomic.AddInt64(&p.AbandonedWrites, -1)
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(p.WatchdogTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		atomic.AddInt64(&p.StuckFlushes, 1)
+		p.Warnf("write of %s/%s stuck for more than %v\n", dst.bucket, object, p.WatchdogTimeout)
+		if p.WatchdogAbort {
+			// the write goroutine is abandoned and exits once the backend
+			// returns, keeping its slot until then
+			atomic.AddInt64(&p.AbandonedWrites, 1)
+			if !atomic.CompareAndSwapInt32(&abandoned, 0, 1) {
+				atomic.AddInt64(&p.AbandonedWrites, -1)
+				return <-done
+			}
+			return fmt.Errorf("write of %s/%s aborted after %v", dst.bucket, object, p.WatchdogTimeout)
+		}
+		return <-done
+	}
+}
+
+// acquireWriteSlot : take one of WriteSlots, waiting at most WatchdogTimeout
+// when the watchdog aborts writes, so writes abandoned while holding every
+// slot fail the next ones instead of blocking them
+func (p *PluginContext) acquireWriteSlot(dst destination, object string) error {
+	if p.WriteSlots == nil {
+		return nil
+	}
+	if p.WatchdogTimeout <= 0 || !p.WatchdogAbort {
+		p.WriteSlots <- struct{}{}
+		return nil
+	}
+
+	timer := time.NewTimer(p.WatchdogTimeout)
+	defer timer.Stop()
+	select {
+	case p.WriteSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no write slot for %s/%s after %v, %d abandoned writes still running", dst.bucket, object, p.WatchdogTimeout, atomic.LoadInt64(&p.AbandonedWrites))
+	}
+}
+
+// Tag priorities set with Priority_Map
+const (
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+// priority : priority of tag from the longest matching Priority_Map prefix
+func (p *PluginContext) priority(tag string) string {
+	match, priority := -1, ""
+	for prefix, value := range p.Priorities {
+		if strings.HasPrefix(tag, prefix) && len(prefix) > match {
+			match, priority = len(prefix), value
+		}
+	}
+	return priority
+}
+
+// flushInterval : how long records of tag may wait in the buffer. A
+// matching Tag_Flush_Intervals entry wins, otherwise high priority tags
+// flush six times faster, low priority ones five times slower.
+func (p *PluginContext) flushInterval(tag string) time.Duration {
+	for _, override := range p.FlushIntervals {
+		if ok, _ := path.Match(override.Match, tag); ok {
+			return override.Interval
+		}
+	}
+	switch p.priority(tag) {
+	case priorityHigh:
+		return 10 * time.Second
+	case priorityLow:
+		return 5 * time.Minute
+	}
+	return time.Minute
+}
+
+// compressionLevel : gzip level for a buffer of tag holding size bytes. High
+// priority tags favour latency, low priority ones ratio. With size based
+// compression, buffers below the threshold favour speed over ratio.
+func (p *PluginContext) compressionLevel(tag string, size int) int {
+	switch p.priority(tag) {
+	case priorityHigh:
+		return gzip.BestSpeed
+	case priorityLow:
+		return gzip.BestCompression
+	}
+	if p.SizeBasedCompression && size < p.CompressionSizeThreshold {
+		return gzip.BestSpeed
+	}
+	return p.CompressionLevel
+}
+
+// compressStream : gzip data into a pipe consumed by the upload, so the
+// compressed object is never held in memory as a whole. With bufferSize
+// set, compressed bytes reach the pipe in writes of that size. Closing the
+// returned reader stops the compression early.
+func compressStream(data []byte, level, bufferSize int) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		var bw *bufio.Writer
+		if bufferSize > 0 {
+			bw = bufio.NewWriterSize(pw, bufferSize)
+			w = bw
+		}
+
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := zw.Write(data); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		err = zw.Close()
+		if err == nil && bw != nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// compress : gzip data into a new buffer
+func compress(data []byte, level int) (*bytes.Buffer, error) {
+	var gzipBuffer bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&gzipBuffer, level)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &gzipBuffer, nil
+}
+
+// compressParts : gzip records separated by sep into independently compressed
+// parts, each smaller than maxSize bytes when maxSize is set. Lines are never split.
+func compressParts(data, sep []byte, maxSize, level int) ([]*bytes.Buffer, error) {
+	compressed, err := compress(data, level)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 || compressed.Len() <= maxSize {
+		return []*bytes.Buffer{compressed}, nil
+	}
+
+	chunks := splitLines(data, sep, compressed.Len()/maxSize+1)
+	if len(chunks) == 1 {
+		log.Printf("[warn] single record compresses to %d bytes, above the object size limit\n", compressed.Len())
+		return []*bytes.Buffer{compressed}, nil
+	}
+
+	var parts []*bytes.Buffer
+	for _, chunk := range chunks {
+		chunkParts, err := compressParts(chunk, sep, maxSize, level)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, chunkParts...)
+	}
+	return parts, nil
+}
+
+// splitLines : cut data at the sep line boundaries into at most n chunks of
+// similar size
+func splitLines(data, sep []byte, n int) [][]byte {
+	target := len(data)/n + 1
+	var chunks [][]byte
+	for len(data) > 0 {
+		if len(data) <= target {
+			chunks = append(chunks, data)
+			break
+		}
+		end := bytes.Index(data[target:], sep)
+		if end < 0 {
+			chunks = append(chunks, data)
+			break
+		}
+		end += target + len(sep)
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return chunks
+}
+
+// sortLines : stable sort JSON records separated by sep by the value of
+// field, grouping similar records together so they compress better
+func sortLines(data []byte, field string, sep []byte) []byte {
+	lines := bytes.Split(bytes.TrimSuffix(data, sep), sep)
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		keys[i] = jsoniter.Get(line, field).ToString()
+	}
+
+	index := make([]int, len(lines))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		return keys[index[a]] < keys[index[b]]
+	})
+
+	sorted := make([]byte, 0, len(data))
+	for _, i := range index {
+		sorted = append(sorted, lines[i]...)
+		sorted = append(sorted, sep...)
+	}
+	return sorted
+}
+
+// parseBool : read a boolean config value, accepting fluent-bit style On/Off
+func parseBool(value string, defaultValue bool) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return defaultValue
+	case "on", "yes":
+		return true
+	case "off", "no":
+		return false
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("[warn] Invalid boolean value: %s, using default %v\n", value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// parseFloat : read a decimal config value, falling back to defaultValue
+func parseFloat(value string, defaultValue float64) float64 {
+	if value == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("[warn] Invalid number value: %s, using default %v\n", value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+// parseInt : read an integer config value, falling back to defaultValue
+func parseInt(value string, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[warn] Invalid integer value: %s, using default %v\n", value, defaultValue)
+		return defaultValue
+	}
+	return i
+}
+
+// defaultBufferSize is used when Output_Buffer_Size is missing or invalid
+const defaultBufferSize = 8 * 1024 * 1024
+
+// parseBufferSize : the Output_Buffer_Size in bytes, defaultBufferSize with a
+// warning when value is not a positive size
+func parseBufferSize(value string) int {
+	bufferSize, err := parseSize(value, 1)
+	if err != nil || bufferSize <= 0 {
+		log.Printf("[warn] Invalid buffer size value: %q, using default %d\n", value, defaultBufferSize)
+		return defaultBufferSize
+	}
+	return bufferSize
+}
+
+// parseRecordSeparator : read a Go escaped separator such as \r\n or \x1e,
+// nil for the default newline
+func parseRecordSeparator(value string) []byte {
+	if value == "" {
+		return nil
+	}
+
+	sep, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil || sep == "" {
+		log.Printf("[warn] Invalid record separator: %s, using \\n\n", value)
+		return nil
+	}
+	return []byte(sep)
+}
+
+// FlushInterval is the flush interval of the tags matching a glob
+type FlushInterval struct {
+	Match    string
+	Interval time.Duration
+}
+
+// parseFlushIntervals : read a tagGlob=duration list separated by commas
+func parseFlushIntervals(value string) []FlushInterval {
+	var intervals []FlushInterval
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		match, duration, ok := strings.Cut(entry, "=")
+		match = strings.TrimSpace(match)
+		interval, err := time.ParseDuration(strings.TrimSpace(duration))
+		if _, globErr := path.Match(match, ""); !ok || err != nil || interval <= 0 || globErr != nil {
+			log.Printf("[warn] Invalid tag flush interval entry: %s, expected tagGlob=duration\n", entry)
+			continue
+		}
+		intervals = append(intervals, FlushInterval{Match: match, Interval: interval})
+	}
+	return intervals
+}
+
+// sizeSuffixes are the units accepted by parseSize
+var sizeSuffixes = map[string]int{
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+}
+
+// parseSize : read a size such as 512KB, 4MB or 1GB in bytes. Bare
+// integers are counted in unit bytes, keeping the meaning the key had
+// before suffixes were accepted.
+func parseSize(value string, unit int) (int, error) {
+	value = strings.TrimSpace(value)
+	number := strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	if suffix := strings.ToUpper(value[len(number):]); suffix != "" {
+		multiplier, ok := sizeSuffixes[suffix]
+		if !ok {
+			return 0, fmt.Errorf("invalid size suffix %q in %q", suffix, value)
+		}
+		unit = multiplier
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * unit, nil
+}
+
+// parseSizeValue : read a size config value, falling back to defaultValue
+func parseSizeValue(value string, unit, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+
+	size, err := parseSize(value, unit)
+	if err != nil {
+		log.Printf("[warn] Invalid size value: %s, using default %v\n", value, defaultValue)
+		return defaultValue
+	}
+	return size
+}
+
+// parsePriorityMap : read a tagPrefix=high|low list separated by commas
+func parsePriorityMap(value string) map[string]string {
+	priorities := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, priority, ok := strings.Cut(entry, "=")
+		priority = strings.ToLower(strings.TrimSpace(priority))
+		if !ok || (priority != priorityHigh && priority != priorityLow) {
+			log.Printf("[warn] Invalid priority map entry: %s, expected tagPrefix=high|low\n", entry)
+			continue
+		}
+		priorities[strings.TrimSpace(prefix)] = priority
+	}
+	return priorities
+}
+
+// parseStorageClass : the upper-cased storage class, empty with a warning when unknown
+func parseStorageClass(value string) string {
+	class := strings.ToUpper(strings.TrimSpace(value))
+	if class != "" && !storageClasses[class] {
+		log.Printf("[warn] Invalid storage class: %s, using the bucket default\n", value)
+		return ""
+	}
+	return class
+}
+
+// parseStorageClassMap : read a tagPrefix=CLASS list separated by commas
+func parseStorageClassMap(value string) map[string]string {
+	classes := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, class, ok := strings.Cut(entry, "=")
+		class = strings.ToUpper(strings.TrimSpace(class))
+		if !ok || !storageClasses[class] {
+			log.Printf("[warn] Invalid storage class map entry: %s, expected tagPrefix=CLASS\n", entry)
+			continue
+		}
+		classes[strings.TrimSpace(prefix)] = class
+	}
+	return classes
+}
+
 func getCurrentJstTime() time.Time {
-	now := time.Now()
-	_, offset := now.Zone()
+	return toJstTime(time.Now())
+}
+
+// toJstTime : move t to JST when the local zone is UTC
+func toJstTime(t time.Time) time.Time {
+	_, offset := t.Zone()
 	if offset == 0 {
 		jst := time.FixedZone("JST", 9*60*60)
-		return now.In(jst)
+		return t.In(jst)
 	}
-	return now
+	return t
 }
 
-// GenerateObjectKey : gen format object name PREFIX/YEAR/MONTH/DAY/tag/timestamp_uuid.log
-func GenerateObjectKey(prefix, tag string, t time.Time) string {
-	year, month, day := t.Date()
-	date_str := fmt.Sprintf("%04d/%02d/%02d", year, month, day)
-	fileName := fmt.Sprintf("%s/%d_%s.log.gz", date_str, t.Unix(), uuid.Must(uuid.NewRandom()).String())
-	return filepath.Join(prefix, tag, fileName)
+// eventTime : convert a fluent-bit record timestamp to a time.Time
+func eventTime(ts interface{}) time.Time {
+	switch t := ts.(type) {
+	case output.FLBTime:
+		return t.Time
+	case uint64:
+		return time.Unix(int64(t), 0)
+	default:
+		return time.Now()
+	}
 }
 
 func parseMap(mapInterface map[interface{}]interface{}) map[string]interface{} {
@@ -188,15 +1880,30 @@ func parseMap(mapInterface map[interface{}]interface{}) map[string]interface{} {
 }
 
 func createJSON(key string, record map[interface{}]interface{}) ([]byte, error) {
+	return marshalRecord(recordData(key, record))
+}
+
+// recordData : the record as a string keyed map, or its key field when it
+// holds one. Dots in key address nested fields, a top-level field named
+// after the whole key wins.
+func recordData(key string, record map[interface{}]interface{}) map[string]interface{} {
 	m := parseMap(record)
 
-	var data map[string]interface{}
-	if val, ok := m[key]; ok {
-		data = val.(map[string]interface{})
-	} else {
-		data = m
+	if val, ok := m[key].(map[string]interface{}); ok {
+		return val
 	}
+	val := m
+	for _, segment := range strings.Split(key, ".") {
+		nested, ok := val[segment].(map[string]interface{})
+		if !ok {
+			return m
+		}
+		val = nested
+	}
+	return val
+}
 
+func marshalRecord(data map[string]interface{}) ([]byte, error) {
 	js, err := jsoniter.Marshal(data)
 	if err != nil {
 		return []byte("{}"), err
@@ -207,7 +1914,46 @@ func createJSON(key string, record map[interface{}]interface{}) ([]byte, error)
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	exitPlugin()
 	return output.FLB_OK
 }
 
+// exitPlugin : flush the remaining buffers of every plugin instance and
+// close their storage clients
+func exitPlugin() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stopSignalFlush()
+	for _, ctx := range contexts {
+		ctx.stopHeartbeat()
+		ctx.stopCompactor()
+		ctx.stopBlockingRetries()
+		ctx.flushAll()
+		if ctx.MaxInflightRetryBuffers > 0 {
+			ctx.spillRetrying()
+		}
+		if ctx.AdminServer != nil {
+			ctx.AdminServer.Close()
+		}
+		ctx.closeClients()
+	}
+	contexts = nil
+}
+
+// closeClients : close the storage clients of the plugin and of its routes
+func (p *PluginContext) closeClients() {
+	clients := []StorageClient{p.Client}
+	for _, route := range p.Routes {
+		clients = append(clients, route.Client)
+	}
+	for _, client := range clients {
+		if closer, ok := client.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				p.Warnf("error closing storage client: %v\n", err)
+			}
+		}
+	}
+}
+
 func main() {}
@@ -1,12 +1,120 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/api/googleapi"
 )
 
+type mockClient struct {
+	objects map[string][]byte
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{objects: make(map[string][]byte)}
+}
+
+func (m *mockClient) Write(bucket, object string, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	m.objects[bucket+"/"+object] = data
+	return nil
+}
+
+func (m *mockClient) Read(bucket, object string) (io.ReadCloser, error) {
+	data, ok := m.objects[bucket+"/"+object]
+	if !ok {
+		return nil, fmt.Errorf("object %s/%s not found", bucket, object)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *mockClient) Delete(bucket, object string) error {
+	if _, ok := m.objects[bucket+"/"+object]; !ok {
+		return fmt.Errorf("object %s/%s not found", bucket, object)
+	}
+	delete(m.objects, bucket+"/"+object)
+	return nil
+}
+
+func (m *mockClient) Exists(bucket, object string) (bool, int64, error) {
+	data, ok := m.objects[bucket+"/"+object]
+	return ok, int64(len(data)), nil
+}
+
+// corruptingClient reads back different bytes than were written
+type corruptingClient struct {
+	*mockClient
+}
+
+func (c *corruptingClient) Read(bucket, object string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("corrupted")), nil
+}
+
+type hangingClient struct {
+	release chan struct{}
+}
+
+func (h *hangingClient) Write(bucket, object string, content io.Reader) error {
+	<-h.release
+	return nil
+}
+
+type failingClient struct {
+	err error
+	// attempts counts the writes tried
+	attempts int
+}
+
+func (f *failingClient) Write(bucket, object string, content io.Reader) error {
+	f.attempts++
+	// consume part of the content before failing, like an interrupted upload
+	io.CopyN(io.Discard, content, 16)
+	return f.err
+}
+
+// prefixFailingClient fails writes of objects under prefix
+type prefixFailingClient struct {
+	*mockClient
+	prefix string
+	err    error
+}
+
+func (f *prefixFailingClient) Write(bucket, object string, content io.Reader) error {
+	if strings.HasPrefix(object, f.prefix) {
+		return f.err
+	}
+	return f.mockClient.Write(bucket, object, content)
+}
+
+func newTestContext(client StorageClient, cfg map[string]string) *PluginContext {
+	return &PluginContext{
+		Client:           client,
+		BufferSize:       1024 * 1024,
+		Buffers:          make(map[string]*TagBuffer),
+		Config:           cfg,
+		CompressionLevel: gzip.DefaultCompression,
+	}
+}
+
 func TestGenerateObjectKey(t *testing.T) {
 
 	prefix := "daily"
@@ -21,6 +129,53 @@ func TestGenerateObjectKey(t *testing.T) {
 	}
 }
 
+func TestKeyFormatDateFormat(t *testing.T) {
+	timestamp := time.Date(2024, 4, 1, 10, 30, 0, 0, time.FixedZone("JST", 9*60*60))
+	tests := []struct {
+		dateFormat string
+		want       string
+	}{
+		{"", "daily/event_log/2024/04/01/"},
+		{"2006/01/02", "daily/event_log/2024/04/01/"},
+		{"2006-01-02", "daily/event_log/2024-04-01/"},
+	}
+
+	for _, tt := range tests {
+		got := KeyFormat{DateFormat: tt.dateFormat}.ObjectKey("daily", "event_log", timestamp, nil)
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("ObjectKey() with %q = %v, want prefix %v", tt.dateFormat, got, tt.want)
+		}
+		if segments := strings.Split(strings.TrimPrefix(got, tt.want), "/"); len(segments) != 1 {
+			t.Errorf("ObjectKey() with %q = %v, want the file name right after the date", tt.dateFormat, got)
+		}
+	}
+}
+
+func TestGenerateObjectKeyPathTraversal(t *testing.T) {
+	tests := []struct {
+		prefix string
+		tag    string
+		want   string
+	}{
+		{"daily", "../../etc", "daily/__/__/etc/"},
+		{"daily", "a/./b", "daily/a/_/b/"},
+		{"../daily", "app.log", "__/daily/app.log/"},
+		{"daily", "a.b.c", "daily/a.b.c/"},
+	}
+
+	for _, tt := range tests {
+		got := GenerateObjectKey(tt.prefix, tt.tag, time.Now())
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("GenerateObjectKey(%q, %q) = %v, want prefix %v", tt.prefix, tt.tag, got, tt.want)
+		}
+		for _, segment := range strings.Split(got, "/") {
+			if segment == ".." || segment == "." {
+				t.Errorf("GenerateObjectKey(%q, %q) = %v, contains %q segment", tt.prefix, tt.tag, got, segment)
+			}
+		}
+	}
+}
+
 func TestGetCurrentJstTime(t *testing.T) {
 	now := time.Now()
 	_, offset := now.Zone()
@@ -38,3 +193,1673 @@ func TestGetCurrentJstTime(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBool(t *testing.T) {
+	tests := []struct {
+		value        string
+		defaultValue bool
+		want         bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"On", false, true},
+		{"off", true, false},
+		{"true", false, true},
+		{"false", true, false},
+		{"invalid", true, true},
+	}
+
+	for _, tt := range tests {
+		if got := parseBool(tt.value, tt.defaultValue); got != tt.want {
+			t.Errorf("parseBool(%q, %v) = %v, want %v", tt.value, tt.defaultValue, got, tt.want)
+		}
+	}
+}
+
+func TestParseBufferSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", defaultBufferSize},
+		{"abc", defaultBufferSize},
+		{"-1", defaultBufferSize},
+		{"0", defaultBufferSize},
+		{"1048576", 1048576},
+		{"4MB", 4 * 1024 * 1024},
+		{"4XB", defaultBufferSize},
+	}
+
+	for _, tt := range tests {
+		if got := parseBufferSize(tt.value); got != tt.want {
+			t.Errorf("parseBufferSize(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		unit  int
+		want  int
+	}{
+		{"512KB", 1, 512 * 1024},
+		{"4MB", 1, 4 * 1024 * 1024},
+		{"1GB", 1, 1024 * 1024 * 1024},
+		{"4mb", 1, 4 * 1024 * 1024},
+		{"16 MB", 1, 16 * 1024 * 1024},
+		{"1048576", 1, 1048576},
+		{"64", 1024 * 1024, 64 * 1024 * 1024},
+		{"512KB", 1024 * 1024, 512 * 1024},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value, tt.unit)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q, %v) = %v, %v, want %v", tt.value, tt.unit, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "MB", "4TB", "4XB", "four", "1.5MB"} {
+		if got, err := parseSize(value, 1); err == nil {
+			t.Errorf("parseSize(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestPerTagBuffers(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	if err := ctx.addRecord("app.a", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.addRecord("app.b", []byte(`{"msg":"b"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Buffers) != 2 {
+		t.Fatalf("len(Buffers) = %v, want %v", len(ctx.Buffers), 2)
+	}
+
+	if err := ctx.flushExpired(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 2 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 2)
+	}
+	for _, tag := range []string{"app.a", "app.b"} {
+		found := 0
+		for key := range client.objects {
+			if strings.HasPrefix(key, "bucket/logs/"+tag+"/") {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("objects for tag %v = %v, want %v", tag, found, 1)
+		}
+	}
+}
+
+func TestFlushSplitsLargeObjects(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxObjectSize = 16 * 1024
+
+	var want []string
+	for i := 0; i < 2000; i++ {
+		line := fmt.Sprintf(`{"id":%d,"value":"%s"}`, i, uuid.Must(uuid.NewRandom()).String())
+		want = append(want, line)
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) < 2 {
+		t.Fatalf("objects written = %v, want several parts", len(client.objects))
+	}
+
+	keys := make([]string, 0, len(client.objects))
+	for key, data := range client.objects {
+		if len(data) > ctx.MaxObjectSize {
+			t.Errorf("object %v is %d bytes, above limit %d", key, len(data), ctx.MaxObjectSize)
+		}
+		if !strings.Contains(key, "_part") {
+			t.Errorf("object %v has no part suffix", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	for _, key := range keys {
+		zr, err := gzip.NewReader(bytes.NewReader(client.objects[key]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("recovered %d lines, want %d lines in order", len(got), len(want))
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	var data bytes.Buffer
+	levels := []string{"info", "error", "debug", "warn"}
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&data, `{"level":"%s","id":%d}`+"\n", levels[i%len(levels)], i)
+	}
+
+	sorted := sortLines(data.Bytes(), "level", defaultRecordSeparator)
+	lines := strings.Split(strings.TrimSuffix(string(sorted), "\n"), "\n")
+	if len(lines) != 4000 {
+		t.Fatalf("len(lines) = %v, want %v", len(lines), 4000)
+	}
+
+	previous := ""
+	for _, line := range lines {
+		level := jsoniter.Get([]byte(line), "level").ToString()
+		if level < previous {
+			t.Fatalf("line %v is out of order after level %v", line, previous)
+		}
+		previous = level
+	}
+
+	unsortedSize, err := compress(data.Bytes(), gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortedSize, err := compress(sorted, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sortedSize.Len() >= unsortedSize.Len() {
+		t.Errorf("sorted compressed size = %v, want less than %v", sortedSize.Len(), unsortedSize.Len())
+	}
+}
+
+func TestWatchdogStuckWrite(t *testing.T) {
+	client := &hangingClient{release: make(chan struct{})}
+	defer close(client.release)
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.WatchdogTimeout = 50 * time.Millisecond
+	ctx.WatchdogAbort = true
+
+	err := ctx.writeObject(ctx.destination("app"), "object", strings.NewReader("data"), WriteOptions{})
+	if err == nil {
+		t.Fatal("writeObject() returned no error for an aborted write")
+	}
+	if got := atomic.LoadInt64(&ctx.StuckFlushes); got != 1 {
+		t.Errorf("StuckFlushes = %v, want %v", got, 1)
+	}
+}
+
+func TestFlushKeepsBufferOnWriteError(t *testing.T) {
+	ctx := newTestContext(&failingClient{err: fmt.Errorf("connection reset")}, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err == nil {
+		t.Fatal("flushBuffer() returned no error for a failed write")
+	}
+	if got := ctx.Buffers["app"].Buffer.String(); got != "{\"msg\":\"a\"}\n" {
+		t.Errorf("Buffer = %q, want the record kept for retry", got)
+	}
+}
+
+// chunkOf : iterate over records like a fluent-bit chunk
+func chunkOf(records ...map[interface{}]interface{}) recordIterator {
+	return func() (int, interface{}, map[interface{}]interface{}) {
+		if len(records) == 0 {
+			return -1, nil, nil
+		}
+		record := records[0]
+		records = records[1:]
+		return 0, uint64(time.Now().Unix()), record
+	}
+}
+
+// objectLines : the decompressed lines of every object written to client
+func objectLines(t *testing.T, client *mockClient) []string {
+	t.Helper()
+	var lines []string
+	for key, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("object %s: %v", key, err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("object %s: %v", key, err)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestFlushChunkRetriesFromBuffer(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.FlushRecordCount = 2
+
+	chunk := chunkOf(
+		map[interface{}]interface{}{"msg": "a"},
+		map[interface{}]interface{}{"msg": "b"},
+		map[interface{}]interface{}{"msg": "c"},
+	)
+	if ret := ctx.flushChunk("app", chunk); ret != output.FLB_OK {
+		t.Fatalf("flushChunk() = %v, want FLB_OK once the records are buffered", ret)
+	}
+	if len(client.objects) != 0 {
+		t.Fatalf("objects written = %v, want none with a failing client", len(client.objects))
+	}
+
+	// the next chunk once the retry is due
+	client.fail = false
+	ctx.Buffers["app"].RetryAfter = time.Time{}
+	if ret := ctx.flushChunk("app", chunkOf(map[interface{}]interface{}{"msg": "d"})); ret != output.FLB_OK {
+		t.Fatalf("flushChunk() = %v, want FLB_OK", ret)
+	}
+
+	want := []string{`{"msg":"a"}`, `{"msg":"b"}`, `{"msg":"c"}`, `{"msg":"d"}`}
+	if got := objectLines(t, client.mockClient); !reflect.DeepEqual(got, want) {
+		t.Errorf("written lines = %v, want each record once %v", got, want)
+	}
+	if len(client.objects) != 2 {
+		t.Errorf("objects written = %v, want the failed flush retried alone then the rest", len(client.objects))
+	}
+}
+
+func TestOverflowBackpressure(t *testing.T) {
+	for _, backpressure := range []bool{false, true} {
+		client := &toggleClient{mockClient: newMockClient(), fail: true}
+		ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+		ctx.BufferSize = 64
+		ctx.MaxAdaptiveBufferSize = 4 * 64
+		ctx.Backpressure = backpressure
+
+		var err error
+		for err == nil {
+			err = ctx.addRecord("app", []byte(`{"msg":"0123456789abcdef"}`), time.Now())
+		}
+		size := ctx.Buffers["app"].CurrentBufferSize
+
+		ret := ctx.flushChunk("app", chunkOf(map[interface{}]interface{}{"msg": "overflow"}))
+		if backpressure {
+			if ret != output.FLB_RETRY {
+				t.Errorf("flushChunk() = %v, want FLB_RETRY with a full failing buffer", ret)
+			}
+			if got := ctx.Buffers["app"].CurrentBufferSize; got != size {
+				t.Errorf("CurrentBufferSize = %v, want the refused chunk left out %v", got, size)
+			}
+		} else if ret != output.FLB_OK {
+			t.Errorf("flushChunk() = %v, want FLB_OK buffering the chunk", ret)
+		}
+
+		// once writes succeed again, the full buffer is flushed when its
+		// retry is due and the chunk accepted
+		client.fail = false
+		ctx.Buffers["app"].RetryAfter = time.Time{}
+		if ret := ctx.flushChunk("app", chunkOf(map[interface{}]interface{}{"msg": "overflow"})); ret != output.FLB_OK {
+			t.Errorf("flushChunk() = %v after recovery, want FLB_OK", ret)
+		}
+	}
+}
+
+func TestFlushChunkOutageAttempts(t *testing.T) {
+	client := &failingClient{err: fmt.Errorf("service unavailable")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.BufferSize = 64
+	ctx.MaxAdaptiveBufferSize = 4 * 64
+
+	var records []map[interface{}]interface{}
+	for i := 0; i < 1000; i++ {
+		records = append(records, map[interface{}]interface{}{"id": i})
+	}
+	if ret := ctx.flushChunk("app", chunkOf(records...)); ret != output.FLB_OK {
+		t.Fatalf("flushChunk() = %v, want FLB_OK buffering the chunk", ret)
+	}
+	if client.attempts != 1 {
+		t.Fatalf("write attempts = %v for a chunk, want %v", client.attempts, 1)
+	}
+
+	// until the retry is due the overflowing buffer refuses chunks untried
+	buf := ctx.Buffers["app"]
+	size := buf.CurrentBufferSize
+	if ret := ctx.flushChunk("app", chunkOf(records[:1]...)); ret != output.FLB_RETRY {
+		t.Errorf("flushChunk() = %v, want FLB_RETRY with an overflowing buffer", ret)
+	}
+	if client.attempts != 1 || buf.CurrentBufferSize != size {
+		t.Errorf("write attempts = %v, buffered = %v, want %v and %v", client.attempts, buf.CurrentBufferSize, 1, size)
+	}
+
+	// once due, a single retry backs off twice as long
+	buf.RetryAfter = time.Time{}
+	if ret := ctx.flushChunk("app", chunkOf(records[:1]...)); ret != output.FLB_RETRY {
+		t.Errorf("flushChunk() = %v, want FLB_RETRY with an overflowing buffer", ret)
+	}
+	if client.attempts != 2 {
+		t.Errorf("write attempts = %v, want %v", client.attempts, 2)
+	}
+	if delay := time.Until(buf.RetryAfter); delay <= retryBaseDelay || delay > 2*retryBaseDelay {
+		t.Errorf("next retry in %v, want %v", delay, 2*retryBaseDelay)
+	}
+}
+
+func TestBlockingRetry(t *testing.T) {
+	client := &failingClient{err: fmt.Errorf("service unavailable")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.BufferSize = 64
+	ctx.Backpressure = true
+	ctx.BlockingRetry = true
+	ctx.RetryStop = make(chan struct{})
+
+	for i := 0; !ctx.full(ctx.getBuffer("app")); i++ {
+		ctx.addRecord("app", []byte(fmt.Sprintf(`{"id":%d}`, i)), time.Now())
+	}
+	buf := ctx.Buffers["app"]
+	if buf.RetryingSince.IsZero() {
+		t.Fatal("buffer not retrying after a failed flush")
+	}
+
+	// the refused chunk waits for the backoff, then retries once
+	backoff := 200 * time.Millisecond
+	buf.RetryAfter = time.Now().Add(backoff)
+	attempts := client.attempts
+	start := time.Now()
+	if ret := ctx.flushChunk("app", chunkOf(map[interface{}]interface{}{"msg": "a"})); ret != output.FLB_RETRY {
+		t.Errorf("flushChunk() = %v, want FLB_RETRY", ret)
+	}
+	if waited := time.Since(start); waited < backoff || waited > backoff+500*time.Millisecond {
+		t.Errorf("flushChunk() waited %v, want about %v", waited, backoff)
+	}
+	if client.attempts != attempts+1 {
+		t.Errorf("write attempts = %v, want %v", client.attempts, attempts+1)
+	}
+
+	// exiting cuts the wait short without another attempt
+	buf.RetryAfter = time.Now().Add(time.Hour)
+	attempts = client.attempts
+	time.AfterFunc(50*time.Millisecond, func() {
+		mutex.Lock()
+		ctx.stopBlockingRetries()
+		mutex.Unlock()
+	})
+	start = time.Now()
+	if ret := ctx.flushChunk("app", chunkOf(map[interface{}]interface{}{"msg": "a"})); ret != output.FLB_RETRY {
+		t.Errorf("flushChunk() = %v, want FLB_RETRY", ret)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("flushChunk() waited %v after the stop, want it cut short", waited)
+	}
+	if client.attempts != attempts {
+		t.Errorf("write attempts = %v after the stop, want %v", client.attempts, attempts)
+	}
+}
+
+func TestFlushExpiredCarriesOnPastFailures(t *testing.T) {
+	client := &prefixFailingClient{mockClient: newMockClient(), prefix: "logs/app.a/", err: fmt.Errorf("service unavailable")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	for _, tag := range []string{"app.a", "app.b", "app.c"} {
+		if err := ctx.addRecord(tag, []byte(`{"tag":"`+tag+`"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ctx.flushExpired(time.Now().Add(time.Hour))
+	if err == nil || !strings.Contains(err.Error(), "app.a") {
+		t.Errorf("flushExpired() = %v, want the failure of app.a", err)
+	}
+	if len(client.objects) != 2 {
+		t.Errorf("objects written = %v, want the other tags flushed", len(client.objects))
+	}
+}
+
+func TestFlushStreamsCompressedObject(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	var want bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf(`{"id":%d}`, i)
+		want.WriteString(line + "\n")
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 1)
+	}
+	for _, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("decompressed object differs from buffered records")
+		}
+	}
+}
+
+func TestCompressStreamStopsOnClose(t *testing.T) {
+	content := compressStream(bytes.Repeat([]byte(`{"msg":"data"}`+"\n"), 100000), gzip.DefaultCompression, 0)
+	if _, err := io.CopyN(io.Discard, content, 64); err != nil {
+		t.Fatal(err)
+	}
+	content.Close()
+
+	if _, err := content.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Read() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestCompressStreamBufferSize(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&data, `{"id":%d,"value":"%s"}`+"\n", i, uuid.Must(uuid.NewRandom()).String())
+	}
+
+	// each read of a pipe returns the bytes of at most one write
+	writes := func(bufferSize int) int {
+		content := compressStream(data.Bytes(), gzip.DefaultCompression, bufferSize)
+		var compressed bytes.Buffer
+		buf := make([]byte, 4*1024*1024)
+		n := 0
+		for {
+			m, err := content.Read(buf)
+			compressed.Write(buf[:m])
+			if m > 0 {
+				n++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		zr, err := gzip.NewReader(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data.Bytes()) {
+			t.Errorf("decompressed stream with buffer %d differs from the input", bufferSize)
+		}
+		return n
+	}
+
+	unbuffered := writes(0)
+	buffered := writes(256 * 1024)
+	if buffered >= unbuffered {
+		t.Errorf("writes with a 256KB buffer = %v, want fewer than %v unbuffered", buffered, unbuffered)
+	}
+}
+
+func TestSizeBasedCompressionLevel(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{})
+	ctx.CompressionLevel = gzip.BestCompression
+	ctx.CompressionSizeThreshold = 1024
+
+	if got := ctx.compressionLevel("app", 100); got != gzip.BestCompression {
+		t.Errorf("compressionLevel(100) without schedule = %v, want %v", got, gzip.BestCompression)
+	}
+
+	ctx.SizeBasedCompression = true
+	if got := ctx.compressionLevel("app", 100); got != gzip.BestSpeed {
+		t.Errorf("compressionLevel(100) = %v, want %v", got, gzip.BestSpeed)
+	}
+	if got := ctx.compressionLevel("app", 4096); got != gzip.BestCompression {
+		t.Errorf("compressionLevel(4096) = %v, want %v", got, gzip.BestCompression)
+	}
+}
+
+func TestSubpartitionByEventTime(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.SubpartitionByEventTime = true
+
+	first := time.Date(2024, 4, 1, 10, 0, 30, 0, time.UTC)
+	second := first.Add(time.Minute)
+	records := []struct {
+		line string
+		time time.Time
+	}{
+		{`{"id":1}`, first},
+		{`{"id":2}`, second},
+		{`{"id":3}`, first.Add(10 * time.Second)},
+	}
+	for _, r := range records {
+		if err := ctx.addRecord("app", []byte(r.line), r.time); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) != 2 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 2)
+	}
+	want := map[int64]string{
+		first.Truncate(time.Minute).Unix():  "{\"id\":1}\n{\"id\":3}\n",
+		second.Truncate(time.Minute).Unix(): "{\"id\":2}\n",
+	}
+	for minute, lines := range want {
+		found := false
+		for key, data := range client.objects {
+			if !strings.Contains(key, fmt.Sprintf("/%d_", minute)) {
+				continue
+			}
+			found = true
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(zr)
+			if string(got) != lines {
+				t.Errorf("object %v = %q, want %q", key, got, lines)
+			}
+		}
+		if !found {
+			t.Errorf("no object for minute %v", minute)
+		}
+	}
+}
+
+func TestFlushDeadLetter(t *testing.T) {
+	client := &prefixFailingClient{mockClient: newMockClient(), prefix: "logs/", err: &googleapi.Error{Code: 403}}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs", "deadLetterPrefix": "dlq"})
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatalf("flushBuffer() = %v, want nil after dead lettering", err)
+	}
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 1)
+	}
+	for key := range client.objects {
+		if !strings.HasPrefix(key, "bucket/dlq/app/") {
+			t.Errorf("dead letter object = %v, want prefix %v", key, "bucket/dlq/app/")
+		}
+	}
+	if ctx.Buffers["app"].Buffer.Len() != 0 {
+		t.Errorf("Buffer.Len() = %v, want %v", ctx.Buffers["app"].Buffer.Len(), 0)
+	}
+}
+
+func TestFlushFailureSkipsWrittenBatches(t *testing.T) {
+	first := time.Date(2024, 4, 1, 10, 0, 30, 0, time.UTC)
+	second := first.Add(time.Minute)
+	failing := fmt.Sprintf("logs/app/2024/04/01/%d_", second.Truncate(time.Minute).Unix())
+
+	for _, err := range []error{&googleapi.Error{Code: 403}, fmt.Errorf("service unavailable")} {
+		client := &prefixFailingClient{mockClient: newMockClient(), prefix: failing, err: err}
+		ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs", "deadLetterPrefix": "dlq"})
+		ctx.SubpartitionByEventTime = true
+
+		for i, ts := range []time.Time{first, second, first} {
+			if err := ctx.addRecord("app", []byte(fmt.Sprintf(`{"id":%d}`, i)), ts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushBuffer(ctx, "app")
+
+		if isRetryable(err) {
+			// the retry only holds the batch that failed
+			if got := ctx.Buffers["app"].Buffer.String(); got != "{\"id\":1}\n" {
+				t.Errorf("Buffer = %q, want only the failed batch kept", got)
+			}
+			client.prefix = "none/"
+			if err := flushBuffer(ctx, "app"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want := []string{`{"id":0}`, `{"id":1}`, `{"id":2}`}
+		if got := objectLines(t, client.mockClient); !reflect.DeepEqual(got, want) {
+			t.Errorf("with %v, written lines = %v, want each record once %v", err, got, want)
+		}
+		deadLetters, wantDeadLetters := 0, 1
+		if isRetryable(err) {
+			wantDeadLetters = 0
+		}
+		for key := range client.objects {
+			if strings.HasPrefix(key, "bucket/dlq/") {
+				deadLetters++
+			}
+		}
+		if deadLetters != wantDeadLetters {
+			t.Errorf("with %v, dead letter objects = %v, want %v", err, deadLetters, wantDeadLetters)
+		}
+	}
+}
+
+func TestContextsHoldIndependentClients(t *testing.T) {
+	first, second := newMockClient(), newMockClient()
+	firstCtx := newTestContext(first, map[string]string{"bucket": "first", "prefix": "logs"})
+	secondCtx := newTestContext(second, map[string]string{"bucket": "second", "prefix": "logs"})
+
+	if err := firstCtx.addRecord("app", []byte(`{"msg":"first"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondCtx.addRecord("app", []byte(`{"msg":"second"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(firstCtx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(secondCtx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for bucket, client := range map[string]*mockClient{"first": first, "second": second} {
+		if len(client.objects) != 1 {
+			t.Fatalf("objects written to %v = %v, want %v", bucket, len(client.objects), 1)
+		}
+		for key := range client.objects {
+			if !strings.HasPrefix(key, bucket+"/") {
+				t.Errorf("client of %v received object %v", bucket, key)
+			}
+		}
+	}
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	intact, corrupted := newMockClient(), newMockClient()
+	tests := []struct {
+		name    string
+		client  StorageClient
+		mock    *mockClient
+		wantErr bool
+	}{
+		{"intact", intact, intact, false},
+		{"corrupted", &corruptingClient{mockClient: corrupted}, corrupted, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(tt.client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+			ctx.ReadAfterWrite = true
+
+			if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			err := flushBuffer(ctx, "app")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("flushBuffer() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if kept := ctx.Buffers["app"].Buffer.Len() > 0; kept != tt.wantErr {
+				t.Errorf("buffer kept for retry = %v, want %v", kept, tt.wantErr)
+			}
+			if failed := ctx.Status().VerificationFailures > 0; failed != tt.wantErr {
+				t.Errorf("verification failure reported = %v, want %v", failed, tt.wantErr)
+			}
+			if stored := len(tt.mock.objects) > 0; stored == tt.wantErr {
+				t.Errorf("object stored = %v, want the mismatched object deleted", stored)
+			}
+		})
+	}
+}
+
+func TestExitPluginFlushesBuffers(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	contexts = append(contexts, ctx)
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"last"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	exitPlugin()
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 1)
+	}
+	if len(contexts) != 0 {
+		t.Errorf("len(contexts) = %v, want %v", len(contexts), 0)
+	}
+}
+
+func TestPriorityMap(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.Priorities = parsePriorityMap("app.error=high, archive=low, app.error.debug=low, bad")
+
+	if got := ctx.compressionLevel("app.error.http", 4096); got != gzip.BestSpeed {
+		t.Errorf("compressionLevel(high) = %v, want %v", got, gzip.BestSpeed)
+	}
+	if got := ctx.compressionLevel("archive.audit", 4096); got != gzip.BestCompression {
+		t.Errorf("compressionLevel(low) = %v, want %v", got, gzip.BestCompression)
+	}
+	if got := ctx.priority("app.error.debug"); got != priorityLow {
+		t.Errorf("priority(app.error.debug) = %v, want the longest prefix %v", got, priorityLow)
+	}
+	if ctx.flushInterval("app.error.http") >= ctx.flushInterval("archive.audit") {
+		t.Errorf("high priority flush interval %v not shorter than low priority %v",
+			ctx.flushInterval("app.error.http"), ctx.flushInterval("archive.audit"))
+	}
+
+	for _, tag := range []string{"app.error.http", "archive.audit"} {
+		if err := ctx.addRecord(tag, []byte(`{"msg":"a"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctx.flushExpired(time.Now().Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Buffers["app.error.http"].Buffer.Len() != 0 {
+		t.Errorf("high priority buffer not flushed after 30s")
+	}
+	if ctx.Buffers["archive.audit"].Buffer.Len() == 0 {
+		t.Errorf("low priority buffer flushed after 30s")
+	}
+}
+
+func TestObjectHeaderRecord(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.ObjectHeaderRecord = true
+
+	first := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	last := first.Add(30 * time.Second)
+	for _, ts := range []time.Time{last, first, first.Add(time.Second)} {
+		if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("len(lines) = %v, want header and %v records", len(lines), 3)
+		}
+
+		var header objectHeader
+		if err := jsoniter.Unmarshal([]byte(lines[0]), &header); err != nil {
+			t.Fatal(err)
+		}
+		if !header.Meta || header.Tag != "app" || header.Records != 3 {
+			t.Errorf("header = %+v, want _meta, tag %v and %v records", header, "app", 3)
+		}
+		if header.MinTime != first.Format(time.RFC3339Nano) || header.MaxTime != last.Format(time.RFC3339Nano) {
+			t.Errorf("header time range = %v - %v, want %v - %v", header.MinTime, header.MaxTime, first, last)
+		}
+	}
+}
+
+func TestMergeAllTags(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MergeAllTags = true
+
+	tags := []string{"app.a", "app.b", "app.c"}
+	for _, tag := range tags {
+		line, err := ctx.encodeRecord(tag, time.Now(), map[interface{}]interface{}{"msg": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.addRecord(ctx.bufferTag(tag), line, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.flushAll()
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 1)
+	}
+	for key, data := range client.objects {
+		if !strings.HasPrefix(key, "bucket/logs/"+mergedTag+"/") {
+			t.Errorf("object key = %v, want it under the %v tag", key, mergedTag)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(lines) != len(tags) {
+			t.Fatalf("len(lines) = %v, want %v", len(lines), len(tags))
+		}
+		for i, line := range lines {
+			var record map[string]interface{}
+			if err := jsoniter.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			if record["_tag"] != tags[i] {
+				t.Errorf("line %d _tag = %v, want %v", i, record["_tag"], tags[i])
+			}
+		}
+	}
+}
+
+func TestFlushHonorsRetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	client := &prefixFailingClient{
+		mockClient: newMockClient(),
+		err:        &googleapi.Error{Code: http.StatusTooManyRequests, Header: header},
+	}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	start := time.Now()
+	if err := ctx.addRecord("app", []byte(`{"msg":"hello"}`), start); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err == nil {
+		t.Fatal("flushBuffer succeeded with a rate limited client")
+	}
+
+	client.prefix = "nothing/"
+	if err := ctx.flushExpired(start.Add(90 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 0 {
+		t.Errorf("objects written = %v before Retry-After elapsed, want %v", len(client.objects), 0)
+	}
+
+	if err := ctx.flushExpired(start.Add(121 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 1 {
+		t.Errorf("objects written = %v after Retry-After elapsed, want %v", len(client.objects), 1)
+	}
+}
+
+// concurrentClient records how many writes run at once
+type concurrentClient struct {
+	mu          sync.Mutex
+	objects     map[string][]byte
+	inflight    int32
+	maxInflight int32
+	// failSuffix fails writes of objects ending with it
+	failSuffix string
+}
+
+func (c *concurrentClient) Write(bucket, object string, content io.Reader) error {
+	n := atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxInflight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInflight, max, n) {
+			break
+		}
+	}
+
+	if c.failSuffix != "" && strings.HasSuffix(object, c.failSuffix) {
+		return fmt.Errorf("service unavailable")
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Lock()
+	c.objects[bucket+"/"+object] = data
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *concurrentClient) Delete(bucket, object string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.objects, bucket+"/"+object)
+	return nil
+}
+
+func TestParallelParts(t *testing.T) {
+	client := &concurrentClient{objects: make(map[string][]byte)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxObjectSize = 16 * 1024
+	ctx.ParallelParts = 4
+
+	for i := 0; i < 2000; i++ {
+		line := fmt.Sprintf(`{"id":%d,"value":"%s"}`, i, uuid.Must(uuid.NewRandom()).String())
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) < 2 {
+		t.Fatalf("objects written = %v, want several parts", len(client.objects))
+	}
+	if client.maxInflight < 2 || client.maxInflight > 4 {
+		t.Errorf("concurrent writes = %v, want between %v and %v", client.maxInflight, 2, 4)
+	}
+
+	lines := 0
+	for _, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(content), "\n")
+	}
+	if lines != 2000 {
+		t.Errorf("lines written = %v, want %v", lines, 2000)
+	}
+}
+
+func TestParallelPartsFailure(t *testing.T) {
+	for _, parallel := range []int{1, 4} {
+		client := &concurrentClient{objects: make(map[string][]byte), failSuffix: "_part0002.log.gz"}
+		ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+		ctx.MaxObjectSize = 16 * 1024
+		ctx.ParallelParts = parallel
+
+		for i := 0; i < 2000; i++ {
+			line := fmt.Sprintf(`{"id":%d,"value":"%s"}`, i, uuid.Must(uuid.NewRandom()).String())
+			if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := flushBuffer(ctx, "app"); err == nil {
+			t.Fatal("flushBuffer succeeded with a failing part")
+		}
+		if ctx.Buffers["app"].Buffer.Len() == 0 {
+			t.Fatal("buffer dropped after a part failed, want it kept for a retry")
+		}
+
+		client.failSuffix = ""
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.Buffers["app"].Buffer.Len() != 0 {
+			t.Errorf("buffer holds %d bytes after the retry, want none", ctx.Buffers["app"].Buffer.Len())
+		}
+
+		// parts written before the failure are not stored again by the retry
+		stored := make(map[string]int)
+		for _, data := range client.objects {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+				stored[line]++
+			}
+		}
+		if len(stored) != 2000 {
+			t.Errorf("ParallelParts %d: distinct lines stored = %v, want %v", parallel, len(stored), 2000)
+		}
+		for line, n := range stored {
+			if n != 1 {
+				t.Errorf("ParallelParts %d: line %s stored %d times, want once", parallel, line, n)
+				break
+			}
+		}
+	}
+}
+
+func TestMaxTotalBufferSize(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxTotalBufferSize = 100
+
+	line := []byte(`{"msg":"0123456789"}`) // 21 bytes buffered
+	for _, tag := range []string{"app.a", "app.a", "app.b", "app.c"} {
+		if err := ctx.addRecord(tag, line, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.objects) != 0 {
+		t.Fatalf("objects written = %v below the cap, want %v", len(client.objects), 0)
+	}
+
+	// 105 bytes across tags, the largest buffer is flushed
+	if err := ctx.addRecord("app.a", line, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want a forced flush", len(client.objects))
+	}
+	for key := range client.objects {
+		if !strings.HasPrefix(key, "bucket/logs/app.a/") {
+			t.Errorf("flushed %v, want the largest buffer app.a", key)
+		}
+	}
+	if ctx.Buffers["app.a"].CurrentBufferSize != 0 || ctx.Buffers["app.b"].CurrentBufferSize != 21 {
+		t.Errorf("buffer sizes = %v and %v, want %v and %v", ctx.Buffers["app.a"].CurrentBufferSize, ctx.Buffers["app.b"].CurrentBufferSize, 0, 21)
+	}
+}
+
+// optionsClient records the attributes of written objects
+type optionsClient struct {
+	*mockClient
+	opts map[string]WriteOptions
+}
+
+func (o *optionsClient) WriteWithOptions(bucket, object string, content io.Reader, opts WriteOptions) error {
+	o.opts[bucket+"/"+object] = opts
+	return o.mockClient.Write(bucket, object, content)
+}
+
+func TestTimeRangeMetadata(t *testing.T) {
+	client := &optionsClient{mockClient: newMockClient(), opts: make(map[string]WriteOptions)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.TimeRangeMetadata = true
+
+	first := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	last := first.Add(90 * time.Second)
+	for _, ts := range []time.Time{first.Add(time.Minute), last, first} {
+		if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.opts) != 1 {
+		t.Fatalf("objects with options = %v, want %v", len(client.opts), 1)
+	}
+	for key, opts := range client.opts {
+		metadata := opts.Metadata
+		if metadata["min-timestamp"] != first.Format(time.RFC3339Nano) {
+			t.Errorf("%v min-timestamp = %v, want %v", key, metadata["min-timestamp"], first.Format(time.RFC3339Nano))
+		}
+		if metadata["max-timestamp"] != last.Format(time.RFC3339Nano) {
+			t.Errorf("%v max-timestamp = %v, want %v", key, metadata["max-timestamp"], last.Format(time.RFC3339Nano))
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	client := &optionsClient{mockClient: newMockClient(), opts: make(map[string]WriteOptions)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.StorageClass = parseStorageClass("standard")
+	ctx.StorageClasses = parseStorageClassMap("archive=COLDLINE, archive.audit=archive, bad=HOT")
+
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"app", "STANDARD"},
+		{"archive.app", "COLDLINE"},
+		{"archive.audit.login", "ARCHIVE"},
+		{"bad", "STANDARD"},
+	}
+	for _, tt := range tests {
+		if got := ctx.storageClass(tt.tag); got != tt.want {
+			t.Errorf("storageClass(%v) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+
+	for _, tag := range []string{"app", "archive.app"} {
+		if err := ctx.addRecord(tag, []byte(`{"msg":"a"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.opts) != 2 {
+		t.Fatalf("objects with options = %v, want %v", len(client.opts), 2)
+	}
+	for key, opts := range client.opts {
+		want := "STANDARD"
+		if strings.HasPrefix(key, "bucket/logs/archive.app/") {
+			want = "COLDLINE"
+		}
+		if opts.StorageClass != want {
+			t.Errorf("%v StorageClass = %v, want %v", key, opts.StorageClass, want)
+		}
+	}
+
+	if got := parseStorageClass("HOT"); got != "" {
+		t.Errorf("parseStorageClass(HOT) = %v, want the bucket default", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var logs bytes.Buffer
+	client := &failingClient{err: fmt.Errorf("write called in dry run")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.Logger = &Logger{Output: func(msg string) { logs.WriteString(msg) }}
+	ctx.DryRun = true
+	ctx.ReadAfterWrite = true
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"hello"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatalf("flushBuffer() = %v, want the write skipped", err)
+	}
+
+	if !strings.Contains(logs.String(), "dry run, not writing") || !strings.Contains(logs.String(), "bucket/logs/app/") {
+		t.Errorf("logs = %q, want the intended object key", logs.String())
+	}
+	if status := ctx.Status(); status.LastFlush.IsZero() || status.LastError != "" {
+		t.Errorf("Status() = %+v, want a successful flush", status)
+	}
+}
+
+// bucketClient records the buckets it is asked to create
+type bucketClient struct {
+	*mockClient
+	buckets map[string]string
+}
+
+func (b *bucketClient) BucketExists(bucket string) (bool, error) {
+	_, ok := b.buckets[bucket]
+	return ok, nil
+}
+
+func (b *bucketClient) CreateBucket(bucket, location string) error {
+	b.buckets[bucket] = location
+	return nil
+}
+
+func TestEnsureBucket(t *testing.T) {
+	client := &bucketClient{mockClient: newMockClient(), buckets: map[string]string{"existing": "US"}}
+
+	ctx := newTestContext(client, map[string]string{"bucket": "missing", "region": "europe-west1"})
+	if err := ctx.ensureBucket(); err != nil {
+		t.Fatal(err)
+	}
+	if client.buckets["missing"] != "europe-west1" {
+		t.Errorf("bucket created in %q, want %q", client.buckets["missing"], "europe-west1")
+	}
+
+	ctx = newTestContext(client, map[string]string{"bucket": "existing", "region": "europe-west1"})
+	if err := ctx.ensureBucket(); err != nil {
+		t.Fatal(err)
+	}
+	if client.buckets["existing"] != "US" {
+		t.Errorf("existing bucket moved to %q, want it untouched", client.buckets["existing"])
+	}
+}
+
+// appendClient appends objects by concatenating their bytes
+type appendClient struct {
+	*mockClient
+	maxBytes int64
+}
+
+func (a *appendClient) Append(bucket, object, member string, opts WriteOptions) (string, error) {
+	data, ok := a.objects[bucket+"/"+member]
+	if !ok {
+		return "", fmt.Errorf("object %s/%s not found", bucket, member)
+	}
+	target, _, err := appendTarget(object, a.maxBytes, func(name string) (int64, int64, bool, error) {
+		existing, ok := a.objects[bucket+"/"+name]
+		return 0, int64(len(existing)), ok, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	a.objects[bucket+"/"+target] = append(a.objects[bucket+"/"+target], data...)
+	delete(a.objects, bucket+"/"+member)
+	return target, nil
+}
+
+func TestAppendMode(t *testing.T) {
+	client := &appendClient{mockClient: newMockClient()}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.AppendMode = true
+	ctx.KeyFormat.Hourly = true
+
+	for _, line := range []string{`{"batch":1}`, `{"batch":2}`} {
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects = %v, want a single hourly object", len(client.objects))
+	}
+	for key, data := range client.objects {
+		if !strings.HasSuffix(key, "/"+getCurrentJstTime().Format("15")+".log.gz") {
+			t.Errorf("object key = %v, want it named after the hour", key)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "{\"batch\":1}\n{\"batch\":2}\n"; string(content) != want {
+			t.Errorf("decompressed object = %q, want %q", content, want)
+		}
+	}
+}
+
+func TestAppendModeMaxObjectBytes(t *testing.T) {
+	client := &appendClient{mockClient: newMockClient(), maxBytes: 1}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.AppendMode = true
+	ctx.KeyFormat.Hourly = true
+
+	for _, line := range []string{`{"batch":1}`, `{"batch":2}`, `{"batch":3}`} {
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hour := getCurrentJstTime().Format("15")
+	var keys []string
+	for key := range client.objects {
+		keys = append(keys, key[strings.LastIndex(key, "/")+1:])
+	}
+	sort.Strings(keys)
+	want := []string{hour + ".log.gz", hour + "_part0001.log.gz", hour + "_part0002.log.gz"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("objects = %v, want %v", keys, want)
+	}
+}
+
+func TestMinCompressionRatio(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MinCompressionRatio = 1.5
+
+	if err := ctx.addRecord("app", bytes.Repeat([]byte(`{"msg":"compressible"}`), 100), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.LowCompressionEvents != 0 {
+		t.Errorf("LowCompressionEvents = %v after compressible records, want %v", ctx.LowCompressionEvents, 0)
+	}
+
+	random := make([]byte, 64*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.addRecord("app", random, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.LowCompressionEvents != 1 {
+		t.Errorf("LowCompressionEvents = %v after random bytes, want %v", ctx.LowCompressionEvents, 1)
+	}
+
+	ctx.MaxObjectSize = 16 * 1024
+	if err := ctx.addRecord("app", random, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.LowCompressionEvents != 2 {
+		t.Errorf("LowCompressionEvents = %v after split random bytes, want %v", ctx.LowCompressionEvents, 2)
+	}
+}
+
+func TestMaxRetryDuration(t *testing.T) {
+	client := &prefixFailingClient{mockClient: newMockClient(), prefix: "logs/", err: fmt.Errorf("service unavailable")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs", "deadLetterPrefix": "dlq"})
+	ctx.MaxRetryDuration = time.Minute
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := flushBuffer(ctx, "app"); err == nil {
+			t.Fatal("flushBuffer() = nil within the retry duration, want a retry")
+		}
+	}
+	if len(client.objects) != 0 {
+		t.Fatalf("objects written = %v within the retry duration, want %v", len(client.objects), 0)
+	}
+
+	ctx.Buffers["app"].RetryingSince = time.Now().Add(-2 * time.Minute)
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatalf("flushBuffer() = %v, want nil after dead lettering", err)
+	}
+	for key := range client.objects {
+		if !strings.HasPrefix(key, "bucket/dlq/app/") {
+			t.Errorf("dead letter object = %v, want prefix %v", key, "bucket/dlq/app/")
+		}
+	}
+	if len(client.objects) != 1 || ctx.Buffers["app"].Buffer.Len() != 0 {
+		t.Errorf("objects = %v, buffered = %v, want the buffer moved to the dead letter prefix", len(client.objects), ctx.Buffers["app"].Buffer.Len())
+	}
+}
+
+func TestRecordSeparator(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.RecordSeparator = parseRecordSeparator(`\r\n`)
+
+	for _, line := range []string{`{"msg":"a"}`, `{"msg":"b"}`, `{"msg":"c"}`} {
+		if err := ctx.addRecord("app", []byte(line), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"msg\":\"a\"}\r\n{\"msg\":\"b\"}\r\n{\"msg\":\"c\"}\r\n"
+	for _, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("object content = %q, want %q", got, want)
+		}
+	}
+
+	chunks := splitLines([]byte(want), ctx.RecordSeparator, 3)
+	if len(chunks) < 2 {
+		t.Fatalf("splitLines() = %q, want several chunks", chunks)
+	}
+	for _, chunk := range chunks {
+		if !bytes.HasSuffix(chunk, []byte("}\r\n")) {
+			t.Errorf("chunk = %q, want it cut after a record separator", chunk)
+		}
+	}
+
+	if sep := parseRecordSeparator(`\x1e`); string(sep) != "\x1e" {
+		t.Errorf("parseRecordSeparator(\\x1e) = %q, want %q", sep, "\x1e")
+	}
+	if sep := parseRecordSeparator(`\q`); sep != nil {
+		t.Errorf("parseRecordSeparator(\\q) = %q, want nil", sep)
+	}
+}
+
+// checkingClient counts writes
+type checkingClient struct {
+	*mockClient
+	writes int
+}
+
+func (c *checkingClient) Write(bucket, object string, content io.Reader) error {
+	c.writes++
+	return c.mockClient.Write(bucket, object, content)
+}
+
+func TestSkipIfExists(t *testing.T) {
+	client := &checkingClient{mockClient: newMockClient()}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.KeyFormat.DedupeByContent = true
+	ctx.SkipIfExists = true
+
+	for i := 0; i < 2; i++ {
+		if err := ctx.addRecord("app", []byte(`{"msg":"same"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.writes != 1 {
+		t.Errorf("writes = %v, want %v for an object already written", client.writes, 1)
+	}
+	if ctx.SuccessCount != 2 {
+		t.Errorf("SuccessCount = %v, want the skipped write counted as a success", ctx.SuccessCount)
+	}
+
+	if err := ctx.addRecord("app", []byte(`{"msg":"other"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if client.writes != 2 {
+		t.Errorf("writes = %v, want %v for new content", client.writes, 2)
+	}
+}
+
+func TestFlushRecordCount(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.FlushRecordCount = 10
+
+	for i := 1; i <= 10; i++ {
+		if err := ctx.addRecord("app", []byte(fmt.Sprintf(`{"n":%d}`, i)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if i == 10 {
+			want = 1
+		}
+		if len(client.objects) != want {
+			t.Fatalf("objects written after %d records = %v, want %v", i, len(client.objects), want)
+		}
+	}
+	if got := len(ctx.Buffers["app"].Times); got != 0 {
+		t.Errorf("records buffered after the flush = %v, want %v", got, 0)
+	}
+}
+
+func TestTagFlushIntervals(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.FlushIntervals = parseFlushIntervals("audit.*=10s, debug.*=5m, bad, app=soon")
+	if len(ctx.FlushIntervals) != 2 {
+		t.Fatalf("FlushIntervals = %v, want the two valid entries", ctx.FlushIntervals)
+	}
+
+	start := time.Now()
+	for _, tag := range []string{"audit.login", "debug.trace", "app"} {
+		if err := ctx.addRecord(tag, []byte(`{"msg":"a"}`), start); err != nil {
+			t.Fatal(err)
+		}
+		ctx.Buffers[tag].LastFlushTime = start
+	}
+
+	flushed := func(tag string) bool { return ctx.Buffers[tag].Buffer.Len() == 0 }
+	if err := ctx.flushExpired(start.Add(15 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !flushed("audit.login") || flushed("debug.trace") || flushed("app") {
+		t.Errorf("after 15s flushed audit %v, debug %v, app %v, want audit only",
+			flushed("audit.login"), flushed("debug.trace"), flushed("app"))
+	}
+	if err := ctx.flushExpired(start.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if flushed("debug.trace") || !flushed("app") {
+		t.Errorf("after 2m flushed debug %v, app %v, want app only", flushed("debug.trace"), flushed("app"))
+	}
+	if err := ctx.flushExpired(start.Add(6 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !flushed("debug.trace") {
+		t.Errorf("debug buffer not flushed after 6m")
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxRecordSize = 32
+
+	oversized := []byte(`{"msg":"` + strings.Repeat("x", 64) + `"}`)
+	if err := ctx.addRecord("app", oversized, time.Now()); !errors.Is(err, errRecordTooLarge) {
+		t.Fatalf("addRecord(oversized) = %v, want %v", err, errRecordTooLarge)
+	}
+	if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ctx.Buffers["app"].Buffer.String(); got != "{\"msg\":\"a\"}\n" {
+		t.Errorf("buffer = %q, want the oversized record left out", got)
+	}
+	if got := ctx.Status().OversizedRecords; got != 1 {
+		t.Errorf("OversizedRecords = %v, want %v", got, 1)
+	}
+}
+
+func TestAdaptiveBuffer(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.BufferSize = 64
+	ctx.AdaptiveBuffer = true
+	ctx.MaxAdaptiveBufferSize = 512
+
+	record := []byte(`{"msg":"0123456789abcdef"}`)
+	var err error
+	for err == nil {
+		err = ctx.addRecord("app", record, time.Now())
+	}
+	buf := ctx.Buffers["app"]
+	if buf.RetryingSince.IsZero() {
+		t.Fatal("buffer not retrying after a failed flush")
+	}
+
+	// retrying, the buffer grows past BufferSize without flush attempts
+	for i := 0; i < 10; i++ {
+		if err := ctx.addRecord("app", record, time.Now()); err != nil {
+			t.Fatalf("addRecord() = %v below the adaptive ceiling, want no flush attempt", err)
+		}
+	}
+	if buf.CurrentBufferSize <= ctx.BufferSize || buf.CurrentBufferSize >= ctx.MaxAdaptiveBufferSize {
+		t.Errorf("CurrentBufferSize = %v, want between %v and %v", buf.CurrentBufferSize, ctx.BufferSize, ctx.MaxAdaptiveBufferSize)
+	}
+	buf.RetryAfter = time.Time{}
+	for err = nil; err == nil; {
+		err = ctx.addRecord("app", record, time.Now())
+	}
+	if buf.CurrentBufferSize < ctx.MaxAdaptiveBufferSize || buf.CurrentBufferSize > ctx.MaxAdaptiveBufferSize+len(record)+1 {
+		t.Errorf("CurrentBufferSize = %v, want a flush attempt at the ceiling %v", buf.CurrentBufferSize, ctx.MaxAdaptiveBufferSize)
+	}
+
+	client.fail = false
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.full(buf) {
+		t.Error("buffer full after a successful flush")
+	}
+	buf.CurrentBufferSize = ctx.BufferSize
+	if !ctx.full(buf) {
+		t.Error("buffer of BufferSize bytes not full once the retry succeeded, want the base size back")
+	}
+}
+
+func TestMaxConcurrentFlushes(t *testing.T) {
+	client := &concurrentClient{objects: make(map[string][]byte)}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxObjectSize = 16 * 1024
+	ctx.ParallelParts = 8
+	ctx.WriteSlots = make(chan struct{}, 2)
+
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf(`{"id":%d,"value":"%s"}`, i, uuid.Must(uuid.NewRandom()).String())
+		for _, tag := range []string{"app.a", "app.b", "app.c"} {
+			if err := ctx.addRecord(tag, []byte(line), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := ctx.flushExpired(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) < 6 {
+		t.Fatalf("objects written = %v, want several parts per tag", len(client.objects))
+	}
+	if client.maxInflight != 2 {
+		t.Errorf("concurrent writes = %v, want %v", client.maxInflight, 2)
+	}
+}
+
+func TestMaxConcurrentFlushesWatchdogAbort(t *testing.T) {
+	client := &hangingClient{release: make(chan struct{})}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.WatchdogTimeout = 50 * time.Millisecond
+	ctx.WatchdogAbort = true
+	ctx.WriteSlots = make(chan struct{}, 1)
+
+	// the abandoned first write keeps its slot, the second gives up waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, object := range []string{"first", "second"} {
+			if err := ctx.writeObject(ctx.destination("app"), object, strings.NewReader("data"), WriteOptions{}); err == nil {
+				t.Errorf("writeObject(%s) returned no error", object)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writeObject() blocked on the slot of an abandoned write")
+	}
+	if got := atomic.LoadInt64(&ctx.StuckFlushes); got != 1 {
+		t.Errorf("StuckFlushes = %v, want %v", got, 1)
+	}
+	if got := ctx.Status().AbandonedWrites; got != 1 {
+		t.Errorf("AbandonedWrites = %v, want %v", got, 1)
+	}
+	if len(ctx.WriteSlots) != 1 {
+		t.Errorf("slots held = %v, want the abandoned write's", len(ctx.WriteSlots))
+	}
+
+	// the slot is freed once the abandoned write returns
+	close(client.release)
+	deadline := time.Now().Add(time.Second)
+	for (len(ctx.WriteSlots) > 0 || atomic.LoadInt64(&ctx.AbandonedWrites) > 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ctx.Status().AbandonedWrites; got != 0 {
+		t.Errorf("AbandonedWrites = %v once the write returned, want %v", got, 0)
+	}
+	if err := ctx.writeObject(ctx.destination("app"), "third", strings.NewReader("data"), WriteOptions{}); err != nil {
+		t.Errorf("writeObject(third) = %v, want the freed slot", err)
+	}
+}
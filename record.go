@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// repeatCountKey holds the number of identical consecutive records collapsed into one
+const repeatCountKey = "_repeat_count"
+
+// sortedJSON encodes records with sorted keys, so identical records encode
+// to identical lines
+var sortedJSON = jsoniter.Config{EscapeHTML: true, SortMapKeys: true}.Froze()
+
+// MetadataFields names the fields carrying the tag, hostname and event
+// time injected into each record
+type MetadataFields struct {
+	TagKey      string
+	HostnameKey string
+	TimeKey     string
+	Hostname    string
+}
+
+// NewMetadataFields : inject metadata under the given keys, empty keys
+// default to _tag, _hostname and _time
+func NewMetadataFields(tagKey, hostnameKey, timeKey string) *MetadataFields {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("[warn] error reading hostname: %v\n", err)
+	}
+
+	fields := &MetadataFields{
+		TagKey:      "_tag",
+		HostnameKey: "_hostname",
+		TimeKey:     "_time",
+		Hostname:    hostname,
+	}
+	if tagKey != "" {
+		fields.TagKey = tagKey
+	}
+	if hostnameKey != "" {
+		fields.HostnameKey = hostnameKey
+	}
+	if timeKey != "" {
+		fields.TimeKey = timeKey
+	}
+	return fields
+}
+
+// inject : add the metadata fields to data, leaving existing keys untouched
+func (f *MetadataFields) inject(data map[string]interface{}, tag string, timestamp time.Time) {
+	for key, value := range map[string]string{
+		f.TagKey:      tag,
+		f.HostnameKey: f.Hostname,
+		f.TimeKey:     timestamp.Format(time.RFC3339Nano),
+	} {
+		if _, exists := data[key]; exists {
+			continue
+		}
+		data[key] = value
+	}
+}
+
+// FieldFilter selects the record fields kept before buffering. Fields are
+// top-level keys or dot separated paths into nested maps.
+type FieldFilter struct {
+	Include [][]string
+	Exclude [][]string
+}
+
+// NewFieldFilter : filter on comma separated include and exclude lists,
+// nil when both are empty
+func NewFieldFilter(include, exclude string) *FieldFilter {
+	filter := &FieldFilter{
+		Include: parseFieldPaths(include),
+		Exclude: parseFieldPaths(exclude),
+	}
+	if len(filter.Include) == 0 && len(filter.Exclude) == 0 {
+		return nil
+	}
+	return filter
+}
+
+func parseFieldPaths(value string) [][]string {
+	var paths [][]string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		paths = append(paths, strings.Split(field, "."))
+	}
+	return paths
+}
+
+// fields : the dot separated included fields, or the excluded ones
+func (f *FieldFilter) fields(include bool) []string {
+	if f == nil {
+		return nil
+	}
+	paths := f.Exclude
+	if include {
+		paths = f.Include
+	}
+	fields := make([]string, len(paths))
+	for i, path := range paths {
+		fields[i] = strings.Join(path, ".")
+	}
+	return fields
+}
+
+// apply : keep only the included fields of data when any are listed, then
+// remove the excluded ones, so exclusion wins when a field is in both
+func (f *FieldFilter) apply(data map[string]interface{}) map[string]interface{} {
+	if len(f.Include) > 0 {
+		kept := make(map[string]interface{})
+		for _, path := range f.Include {
+			copyField(kept, data, path)
+		}
+		data = kept
+	}
+	for _, path := range f.Exclude {
+		deleteField(data, path)
+	}
+	return data
+}
+
+// copyField : copy the field at path from src to dst, creating the nested maps leading to it
+func copyField(dst, src map[string]interface{}, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	child, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+	}
+	copyField(child, nested, path[1:])
+	if len(child) > 0 {
+		dst[path[0]] = child
+	}
+}
+
+// deleteField : remove the field at path from data
+func deleteField(data map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(data, path[0])
+		return
+	}
+	if nested, ok := data[path[0]].(map[string]interface{}); ok {
+		deleteField(nested, path[1:])
+	}
+}
+
+// FieldRename renames a top-level record key
+type FieldRename struct {
+	From string
+	To   string
+}
+
+// parseRenameFields : parse a comma separated old:new list, skipping malformed entries
+func parseRenameFields(value string) []FieldRename {
+	var renames []FieldRename
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, ":")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			log.Printf("[warn] ignoring malformed Rename_Fields entry %q\n", entry)
+			continue
+		}
+		renames = append(renames, FieldRename{From: from, To: to})
+	}
+	return renames
+}
+
+// renameFields : rename the top-level keys of data, leaving a key in place
+// when its new name is already taken
+func renameFields(data map[string]interface{}, renames []FieldRename) {
+	for _, rename := range renames {
+		value, ok := data[rename.From]
+		if !ok || rename.From == rename.To {
+			continue
+		}
+		if _, exists := data[rename.To]; exists {
+			log.Printf("[warn] not renaming field %s, %s already exists\n", rename.From, rename.To)
+			continue
+		}
+		delete(data, rename.From)
+		data[rename.To] = value
+	}
+}
+
+// encodeRecord : convert a fluent-bit record to the JSON line buffered for
+// tag, nil when SkipEmptyRecords drops it
+func (p *PluginContext) encodeRecord(tag string, timestamp time.Time, record map[interface{}]interface{}) ([]byte, error) {
+	if p.PreCompressed {
+		return preCompressedMember(p.Config["jsonKey"], record)
+	}
+	data := recordData(p.Config["jsonKey"], record)
+	if p.FieldFilter != nil {
+		data = p.FieldFilter.apply(data)
+	}
+	renameFields(data, p.RenameFields)
+	if p.SkipEmptyRecords && len(data) == 0 {
+		return nil, nil
+	}
+	if p.MetadataFields != nil {
+		p.MetadataFields.inject(data, tag, timestamp)
+	} else if p.MergeAllTags {
+		// merged objects need the tag inline to tell records apart
+		if _, exists := data["_tag"]; !exists {
+			data["_tag"] = tag
+		}
+	}
+	if p.CollapseConsecutive {
+		line, err := sortedJSON.Marshal(data)
+		if err != nil {
+			return []byte("{}"), err
+		}
+		return line, nil
+	}
+	return marshalRecord(data)
+}
+
+// defaultPreCompressedKey holds the gzip member of records when JSON_Key is unset
+const defaultPreCompressedKey = "log"
+
+// preCompressedMember : the gzip member held by the key field of record
+func preCompressedMember(key string, record map[interface{}]interface{}) ([]byte, error) {
+	if key == "" {
+		key = defaultPreCompressedKey
+	}
+	var member []byte
+	switch value := record[key].(type) {
+	case []byte:
+		member = value
+	case string:
+		member = []byte(value)
+	}
+	if len(member) < 2 || member[0] != 0x1f || member[1] != 0x8b {
+		return nil, fmt.Errorf("field %s of the record is not gzip compressed", key)
+	}
+	return member, nil
+}
+
+// collapseRepeat : count one more repeat of the last line, rewriting it
+// with its repeat count in place, ended by sep
+func (b *TagBuffer) collapseRepeat(sep []byte) {
+	b.Repeats++
+	b.Buffer.Truncate(b.Buffer.Len() - b.LastLineSize)
+	b.CurrentBufferSize -= b.LastLineSize
+
+	line := append([]byte{}, bytes.TrimSuffix(b.LastLine, []byte("}"))...)
+	if len(line) > 1 {
+		line = append(line, ',')
+	}
+	line = fmt.Appendf(line, "%q:%d}", repeatCountKey, b.Repeats)
+	line = append(line, sep...)
+	b.Buffer.Write(line)
+	b.LastLineSize = len(line)
+	b.CurrentBufferSize += len(line)
+}
+
+// partitionTime : the time of the PartitionTimeField of line, a string in
+// PartitionTimeFormat (RFC 3339 by default) or a number of unix seconds.
+// fallback is returned when the field is unset, missing or unparsable.
+func (p *PluginContext) partitionTime(line []byte, fallback time.Time) time.Time {
+	if p.PartitionTimeField == "" {
+		return fallback
+	}
+
+	value := jsoniter.Get(line, p.PartitionTimeField)
+	switch value.ValueType() {
+	case jsoniter.StringValue:
+		format := p.PartitionTimeFormat
+		if format == "" {
+			format = time.RFC3339Nano
+		}
+		if t, err := time.Parse(format, value.ToString()); err == nil {
+			return t
+		}
+	case jsoniter.NumberValue:
+		seconds := value.ToFloat64()
+		return time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+	return fallback
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestEncodeRecordMetadataFields(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{})
+	ctx.MetadataFields = NewMetadataFields("", "", "")
+	ctx.MetadataFields.Hostname = "node-1"
+	timestamp := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	record := map[interface{}]interface{}{
+		"msg":   []byte("hello"),
+		"_tag":  "original",
+		"level": "info",
+	}
+	line, err := ctx.encodeRecord("app", timestamp, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := jsoniter.Unmarshal(line, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"msg":       "hello",
+		"level":     "info",
+		"_tag":      "original",
+		"_hostname": "node-1",
+		"_time":     "2024-04-01T10:00:00Z",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%v = %v, want %v", key, got[key], value)
+		}
+	}
+}
+
+func TestEncodeRecordCustomMetadataKeys(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{})
+	ctx.MetadataFields = NewMetadataFields("fluent_tag", "host", "@timestamp")
+
+	line, err := ctx.encodeRecord("app", time.Now(), map[interface{}]interface{}{"msg": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"fluent_tag", "host", "@timestamp"} {
+		if jsoniter.Get(line, key).ValueType() == jsoniter.InvalidValue {
+			t.Errorf("record %s has no %v field", line, key)
+		}
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	record := func() map[string]interface{} {
+		return map[string]interface{}{
+			"msg":   "hello",
+			"email": "a@example.com",
+			"ssn":   "000-00-0000",
+			"user": map[string]interface{}{
+				"id":    "42",
+				"email": "b@example.com",
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		want    string
+	}{
+		{"include only", "msg,user.id", "", `{"msg":"hello","user":{"id":"42"}}`},
+		{"exclude only", "", "ssn, email,user.email", `{"msg":"hello","user":{"id":"42"}}`},
+		{"exclude wins", "msg,email,user", "email,user.email", `{"msg":"hello","user":{"id":"42"}}`},
+		{"missing fields", "level,user.name", "", `{}`},
+	}
+	for _, tt := range tests {
+		filter := NewFieldFilter(tt.include, tt.exclude)
+		got, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(filter.apply(record()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: apply() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if filter := NewFieldFilter(" ", ""); filter != nil {
+		t.Errorf("NewFieldFilter() = %v, want nil", filter)
+	}
+}
+
+func TestEncodeRecordFieldFilter(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{})
+	ctx.FieldFilter = NewFieldFilter("msg", "")
+	ctx.MetadataFields = NewMetadataFields("", "", "")
+
+	line, err := ctx.encodeRecord("app", time.Now(), map[interface{}]interface{}{
+		"msg":   "hello",
+		"email": "a@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := jsoniter.Unmarshal(line, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["email"]; ok {
+		t.Errorf("email kept in %s", line)
+	}
+	// metadata is injected after filtering
+	if got["_tag"] != "app" {
+		t.Errorf("_tag = %v, want %v", got["_tag"], "app")
+	}
+}
+
+func TestParseRenameFields(t *testing.T) {
+	got := parseRenameFields(" time:@timestamp, bad ,msg:,level:severity")
+	want := []FieldRename{{"time", "@timestamp"}, {"level", "severity"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRenameFields() = %v, want %v", got, want)
+	}
+}
+
+func TestRenameFields(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.RenameFields = parseRenameFields("time:@timestamp,level:msg")
+
+	line, err := ctx.encodeRecord("app", time.Now(), map[interface{}]interface{}{
+		"time":  "2024-04-01T10:30:00Z",
+		"level": "info",
+		"msg":   "hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.addRecord("app", line, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.objects) != 1 {
+		t.Fatalf("objects written = %v, want %v", len(client.objects), 1)
+	}
+	for _, data := range client.objects {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]interface{}
+		if err := jsoniter.Unmarshal([]byte(strings.TrimSpace(string(content))), &got); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got["time"]; ok {
+			t.Errorf("time kept in %s", content)
+		}
+		if got["@timestamp"] != "2024-04-01T10:30:00Z" {
+			t.Errorf("@timestamp = %v, want %v", got["@timestamp"], "2024-04-01T10:30:00Z")
+		}
+		// renaming onto an existing field is skipped
+		if got["level"] != "info" || got["msg"] != "hello" {
+			t.Errorf("level, msg = %v, %v, want %v, %v", got["level"], got["msg"], "info", "hello")
+		}
+	}
+}
+
+func TestCollapseConsecutive(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.CollapseConsecutive = true
+
+	add := func(record map[interface{}]interface{}) {
+		line, err := ctx.encodeRecord("app", time.Now(), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.addRecord("app", line, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		add(map[interface{}]interface{}{"level": "error", "msg": "disk full"})
+	}
+	add(map[interface{}]interface{}{})
+	add(map[interface{}]interface{}{})
+	add(map[interface{}]interface{}{"level": "error", "msg": "disk full"})
+
+	buf := ctx.Buffers["app"]
+	want := `{"level":"error","msg":"disk full","_repeat_count":5}` + "\n" +
+		`{"_repeat_count":2}` + "\n" +
+		`{"level":"error","msg":"disk full"}` + "\n"
+	if buf.Buffer.String() != want {
+		t.Errorf("buffer = %q, want %q", buf.Buffer.String(), want)
+	}
+	if buf.CurrentBufferSize != buf.Buffer.Len() {
+		t.Errorf("CurrentBufferSize = %v, want %v", buf.CurrentBufferSize, buf.Buffer.Len())
+	}
+	if len(buf.Times) != 3 {
+		t.Errorf("len(Times) = %v, want one per buffered record %v", len(buf.Times), 3)
+	}
+}
+
+func TestPartitionTimeField(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.PartitionTimeField = "ts"
+
+	ingest := time.Now()
+	records := []string{
+		`{"ts":"2023-12-31T20:00:00Z","msg":"a"}`, // 2024-01-01 in JST
+		`{"ts":1704153600,"msg":"b"}`,             // 2024-01-02 in JST
+		`{"ts":"2024-01-01T10:00:00+09:00","msg":"c"}`,
+		`{"ts":"yesterday","msg":"d"}`,
+	}
+	for _, record := range records {
+		line := []byte(record)
+		if err := ctx.addRecord("app", line, ctx.partitionTime(line, ingest)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for key, data := range client.objects {
+		date := strings.Join(strings.Split(key, "/")[3:6], "/")
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[date] += strings.Count(string(content), "\n")
+	}
+	want := map[string]int{
+		"2024/01/01":                           2,
+		"2024/01/02":                           1,
+		toJstTime(ingest).Format("2006/01/02"): 1,
+	}
+	for date, n := range want {
+		if counts[date] != n {
+			t.Errorf("records in %v = %v, want %v (all: %v)", date, counts[date], n, counts)
+		}
+	}
+}
+
+func TestSkipEmptyRecords(t *testing.T) {
+	ctx := newTestContext(newMockClient(), map[string]string{"jsonKey": "payload"})
+	ctx.SkipEmptyRecords = true
+	ctx.MetadataFields = NewMetadataFields("", "", "")
+	timestamp := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, record := range []map[interface{}]interface{}{
+		{},
+		{"payload": map[interface{}]interface{}{}},
+	} {
+		line, err := ctx.encodeRecord("app", timestamp, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != nil {
+			t.Errorf("encodeRecord(%v) = %s, want the empty record skipped", record, line)
+		}
+	}
+
+	line, err := ctx.encodeRecord("app", timestamp, map[interface{}]interface{}{"msg": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(line, []byte(`"msg":"a"`)) {
+		t.Errorf("encodeRecord() = %s, want the record kept", line)
+	}
+}
+
+func TestRecordDataKeyPath(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"log": map[interface{}]interface{}{
+			"message": map[interface{}]interface{}{"body": map[interface{}]interface{}{"msg": "nested"}},
+		},
+		"payload": map[interface{}]interface{}{"msg": "top"},
+		"a.b":     map[interface{}]interface{}{"msg": "dotted"},
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"log.message", `{"body":{"msg":"nested"}}`},
+		{"log.message.body", `{"msg":"nested"}`},
+		{"payload", `{"msg":"top"}`},
+		{"a.b", `{"msg":"dotted"}`},
+	}
+	for _, tt := range tests {
+		got, err := createJSON(tt.key, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("createJSON(%q) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+
+	for _, key := range []string{"log.missing.body", "payload.msg", "missing"} {
+		if got := recordData(key, record); len(got) != 3 {
+			t.Errorf("recordData(%q) = %v, want the whole record", key, got)
+		}
+	}
+}
+
+func TestPreCompressed(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.PreCompressed = true
+
+	var want bytes.Buffer
+	for _, line := range []string{"{\"msg\":\"a\"}\n", "{\"msg\":\"b\"}\n"} {
+		member, err := compress([]byte(line), gzip.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := ctx.encodeRecord("app", time.Now(), map[interface{}]interface{}{"log": member.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.addRecord("app", encoded, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		want.Write(member.Bytes())
+	}
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, data := range client.objects {
+		if !strings.HasSuffix(key, ".log.gz") {
+			t.Errorf("object = %v, want a .log.gz key", key)
+		}
+		if !bytes.Equal(data, want.Bytes()) {
+			t.Errorf("object is %d bytes, want the %d bytes of the members as they are", len(data), want.Len())
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "{\"msg\":\"a\"}\n{\"msg\":\"b\"}\n" {
+			t.Errorf("decompressed object = %q, want the records after a single gunzip", got)
+		}
+	}
+
+	if _, err := ctx.encodeRecord("app", time.Now(), map[interface{}]interface{}{"log": "plain"}); err == nil {
+		t.Error("encodeRecord(plain) = nil, want an error for a record that isn't gzip compressed")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Route sends the tags matching a glob to their own bucket, written with
+// the service account of Credential
+type Route struct {
+	// Match is a glob of the routed tags, e.g. `billing.*`
+	Match string `json:"match"`
+	// Bucket receives the objects of the routed tags
+	Bucket string `json:"bucket"`
+	// Credential is the service account file of the route, Application
+	// Default Credentials when empty
+	Credential string `json:"credential"`
+	// Prefix of the object keys, the plugin Prefix when empty
+	Prefix string `json:"prefix"`
+
+	// Client writes the objects of the route, built at init
+	Client StorageClient `json:"-"`
+}
+
+// destination is where the objects of a tag are written
+type destination struct {
+	client StorageClient
+	bucket string
+	prefix string
+}
+
+// parseTagRoutes : decode the JSON array of Tag_Routes, empty for no routes
+func parseTagRoutes(value string) ([]Route, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var routes []Route
+	if err := jsoniter.Unmarshal([]byte(value), &routes); err != nil {
+		return nil, fmt.Errorf("invalid tag routes: %w", err)
+	}
+	for _, route := range routes {
+		if route.Bucket == "" {
+			return nil, fmt.Errorf("invalid tag routes: no bucket for %s", route.Match)
+		}
+		if _, err := path.Match(route.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid tag routes: %s: %w", route.Match, err)
+		}
+	}
+	return routes, nil
+}
+
+// destination : the client, bucket and prefix of the first route matching
+// tag, the plugin ones when no route matches
+func (p *PluginContext) destination(tag string) destination {
+	for _, route := range p.Routes {
+		if ok, _ := path.Match(route.Match, tag); !ok {
+			continue
+		}
+		return p.routeDestination(route)
+	}
+	return destination{client: p.Client, bucket: p.Config["bucket"], prefix: p.Config["prefix"]}
+}
+
+// destinations : the destination of unrouted tags followed by those of every route
+func (p *PluginContext) destinations() []destination {
+	destinations := []destination{{client: p.Client, bucket: p.Config["bucket"], prefix: p.Config["prefix"]}}
+	for _, route := range p.Routes {
+		destinations = append(destinations, p.routeDestination(route))
+	}
+	return destinations
+}
+
+// routeDestination : where route writes, under the plugin prefix when it has none
+func (p *PluginContext) routeDestination(route Route) destination {
+	dst := destination{client: route.Client, bucket: route.Bucket, prefix: route.Prefix}
+	if dst.prefix == "" {
+		dst.prefix = p.Config["prefix"]
+	}
+	return dst
+}
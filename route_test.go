@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagRoutes(t *testing.T) {
+	routes, err := parseTagRoutes(`[
+		{"match": "billing.*", "bucket": "billing-bucket", "credential": "/secure/billing.json"},
+		{"match": "audit.*", "bucket": "audit-bucket", "prefix": "audit"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	billing, audit, fallback := newMockClient(), newMockClient(), newMockClient()
+	routes[0].Client = billing
+	routes[1].Client = audit
+
+	ctx := newTestContext(fallback, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.Routes = routes
+	for _, tag := range []string{"billing.invoices", "audit.login", "app"} {
+		if err := ctx.addRecord(tag, []byte(`{"msg":"a"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		client *mockClient
+		prefix string
+	}{
+		{billing, "billing-bucket/logs/billing.invoices/"},
+		{audit, "audit-bucket/audit/audit.login/"},
+		{fallback, "bucket/logs/app/"},
+	} {
+		if len(tt.client.objects) != 1 {
+			t.Errorf("objects written under %v = %v, want %v", tt.prefix, len(tt.client.objects), 1)
+		}
+		for key := range tt.client.objects {
+			if !strings.HasPrefix(key, tt.prefix) {
+				t.Errorf("object = %v, want prefix %v", key, tt.prefix)
+			}
+		}
+	}
+}
+
+func TestParseTagRoutesInvalid(t *testing.T) {
+	for _, value := range []string{
+		`{"match": "app"}`,
+		`[{"match": "app"}]`,
+		`[{"match": "[", "bucket": "bucket"}]`,
+	} {
+		if _, err := parseTagRoutes(value); err == nil {
+			t.Errorf("parseTagRoutes(%v) = nil, want an error", value)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/oauth2/google"
+)
+
+// secretScheme prefixes a Credential read from Secret Manager, e.g.
+// gcp-secret://projects/x/secrets/y/versions/latest
+const secretScheme = "gcp-secret://"
+
+// fetchSecret reads a Secret Manager secret version, replaced in tests
+var fetchSecret = accessSecretVersion
+
+// accessSecretVersion : read the payload of the secret version name with
+// Application Default Credentials
+func accessSecretVersion(name string) ([]byte, error) {
+	ctx := context.Background()
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get("https://secretmanager.googleapis.com/v1/" + name + ":access")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("accessing secret %s: %s", name, resp.Status)
+	}
+
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return nil, fmt.Errorf("accessing secret %s: %w", name, err)
+	}
+	return base64.StdEncoding.DecodeString(version.Payload.Data)
+}
+
+// secretName : the secret version a Credential refers to, false for a file path
+func secretName(credential string) (string, bool) {
+	if !strings.HasPrefix(credential, secretScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(credential, secretScheme), true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signalStop stops the flush signal handler, nil when it is not running
+var signalStop chan struct{}
+
+// startSignalFlush : flush every plugin instance on SIGUSR1. Must be called
+// with mutex held.
+func startSignalFlush() {
+	if signalStop != nil {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	stop := make(chan struct{})
+	signalStop = stop
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				log.Printf("[info] SIGUSR1 received, flushing all buffers\n")
+				mutex.Lock()
+				for _, ctx := range contexts {
+					ctx.flushAll()
+				}
+				mutex.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSignalFlush : stop the flush signal handler. Must be called with mutex held.
+func stopSignalFlush() {
+	if signalStop != nil {
+		close(signalStop)
+		signalStop = nil
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalFlush(t *testing.T) {
+	client := newMockClient()
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	mutex.Lock()
+	contexts = append(contexts, ctx)
+	startSignalFlush()
+	if err := ctx.addRecord("app", []byte(`{"msg":"a"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		stopSignalFlush()
+		contexts = nil
+		mutex.Unlock()
+	}()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		written := len(client.objects)
+		mutex.Unlock()
+		if written == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("buffer not flushed after SIGUSR1")
+}
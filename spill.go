@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// spilledBuffer is a retrying buffer moved to disk to free memory
+type spilledBuffer struct {
+	Tag  string
+	Path string
+	// RetryAfter and RetryAttempts space out its retries like a TagBuffer's
+	RetryAfter    time.Time
+	RetryAttempts int
+}
+
+// markRetrying : once the buffer of tag failed to flush, spill the oldest
+// retrying buffers beyond MaxInflightRetryBuffers to disk
+func (p *PluginContext) markRetrying(tag string) {
+	if p.MaxInflightRetryBuffers <= 0 {
+		return
+	}
+
+	for {
+		var oldestTag string
+		var oldest *TagBuffer
+		retrying := 0
+		for t, b := range p.Buffers {
+			if b.RetryingSince.IsZero() || b.Buffer.Len() == 0 {
+				continue
+			}
+			retrying++
+			if oldest == nil || b.RetryingSince.Before(oldest.RetryingSince) {
+				oldestTag, oldest = t, b
+			}
+		}
+		if retrying <= p.MaxInflightRetryBuffers {
+			return
+		}
+		if err := p.spill(oldestTag, oldest); err != nil {
+			p.Warnf("error spilling buffer of %s to disk: %v\n", oldestTag, err)
+			return
+		}
+	}
+}
+
+// spillSuffix ends the names of spill files
+const spillSuffix = ".spill"
+
+// spillHeader is the first line of a spill file, describing the records
+// following it so they are retried like the buffer they came from
+type spillHeader struct {
+	Bucket        string      `json:"bucket"`
+	Prefix        string      `json:"prefix"`
+	Tag           string      `json:"tag"`
+	RetryingSince time.Time   `json:"retrying_since"`
+	Times         []time.Time `json:"times"`
+}
+
+// spillPath : a new spill file path for tag under SpillDir
+func (p *PluginContext) spillPath(tag string) string {
+	name := fmt.Sprintf("%s_%d%s", strings.ReplaceAll(tag, "/", "_"), time.Now().UnixNano(), spillSuffix)
+	return filepath.Join(p.SpillDir, name)
+}
+
+// spill : move the content of buf to a file under SpillDir and empty it
+func (p *PluginContext) spill(tag string, buf *TagBuffer) error {
+	if err := os.MkdirAll(p.SpillDir, 0700); err != nil {
+		return err
+	}
+
+	path := p.spillPath(tag)
+	if err := p.writeSpill(path, tag, buf); err != nil {
+		return err
+	}
+	p.Infof("spilled %d bytes of retrying buffer %s to %s\n", buf.Buffer.Len(), tag, path)
+
+	p.Spilled = append(p.Spilled, spilledBuffer{Tag: tag, Path: path, RetryAfter: buf.RetryAfter, RetryAttempts: buf.RetryAttempts})
+	buf.Buffer.Reset()
+	buf.CurrentBufferSize = 0
+	buf.Times = buf.Times[:0]
+	buf.Repeats = 0
+	buf.RetrySize, buf.RetryCount = 0, 0
+	buf.RetryingSince = time.Time{}
+	buf.RetryAfter, buf.RetryAttempts = time.Time{}, 0
+	return nil
+}
+
+// writeSpill : write the records of buf to path behind their header,
+// through a temporary file so a crash never leaves a partial spill file
+func (p *PluginContext) writeSpill(path, tag string, buf *TagBuffer) error {
+	header, err := jsoniter.Marshal(spillHeader{
+		Bucket:        p.Config["bucket"],
+		Prefix:        p.Config["prefix"],
+		Tag:           tag,
+		RetryingSince: buf.RetryingSince,
+		Times:         buf.Times,
+	})
+	if err != nil {
+		return err
+	}
+
+	content := make([]byte, 0, len(header)+1+buf.Buffer.Len())
+	content = append(append(append(content, header...), '\n'), buf.Buffer.Bytes()...)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readSpill : the header and the records of a spill file
+func readSpill(path string) (spillHeader, []byte, error) {
+	var header spillHeader
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return header, nil, err
+	}
+	line, data, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return header, nil, fmt.Errorf("spill file %s has no header", path)
+	}
+	if err := jsoniter.Unmarshal(line, &header); err != nil {
+		return header, nil, fmt.Errorf("spill file %s: %w", path, err)
+	}
+	return header, data, nil
+}
+
+// loadSpilled : claim the spill files left under SpillDir by an earlier
+// process writing to the same bucket and prefix, so they are retried.
+// Files are renamed when claimed, so an instance sharing SpillDir can't
+// pick them up as well.
+func (p *PluginContext) loadSpilled() {
+	entries, err := os.ReadDir(p.SpillDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.Warnf("error reading spill directory %s: %v\n", p.SpillDir, err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spillSuffix) {
+			continue
+		}
+		path := filepath.Join(p.SpillDir, entry.Name())
+		header, _, err := readSpill(path)
+		if err != nil {
+			p.Warnf("skipping unreadable spilled buffer %s: %v\n", path, err)
+			continue
+		}
+		if header.Bucket != p.Config["bucket"] || header.Prefix != p.Config["prefix"] {
+			continue
+		}
+
+		claimed := p.spillPath(header.Tag)
+		if err := os.Rename(path, claimed); err != nil {
+			// claimed by another instance in the meantime
+			continue
+		}
+		p.Infof("retrying buffer %s spilled by an earlier run to %s\n", header.Tag, path)
+		p.Spilled = append(p.Spilled, spilledBuffer{Tag: header.Tag, Path: claimed})
+	}
+}
+
+// spillRetrying : move the buffers still retrying to SpillDir, so they are
+// retried by the next process instead of lost on exit
+func (p *PluginContext) spillRetrying() {
+	for tag, buf := range p.Buffers {
+		if buf.Buffer.Len() == 0 || buf.RetryingSince.IsZero() {
+			continue
+		}
+		if err := p.spill(tag, buf); err != nil {
+			p.Errorf("dropping %d bytes of %s, spilling on exit failed: %v\n", buf.Buffer.Len(), tag, err)
+		}
+	}
+}
+
+// retrySpilled : upload spilled buffers in order once their retry is due,
+// stopping at the first failure. The data stays on disk until written, so
+// errors are only logged.
+func (p *PluginContext) retrySpilled(now time.Time) {
+	for len(p.Spilled) > 0 {
+		spilled := &p.Spilled[0]
+		if now.Before(spilled.RetryAfter) {
+			return
+		}
+		header, data, err := readSpill(spilled.Path)
+		if err != nil {
+			p.Errorf("dropping unreadable spilled buffer %s: %v\n", spilled.Path, err)
+			p.Spilled = p.Spilled[1:]
+			continue
+		}
+
+		buf := &TagBuffer{Times: header.Times, RetryingSince: header.RetryingSince, RetryAttempts: spilled.RetryAttempts}
+		buf.Buffer.Write(data)
+		buf.CurrentBufferSize = len(data)
+		for buf.Buffer.Len() > 0 {
+			if err := p.flushRecords(spilled.Tag, buf); err != nil {
+				spilled.RetryAfter, spilled.RetryAttempts = buf.RetryAfter, buf.RetryAttempts
+				if buf.Buffer.Len() != len(data) {
+					// batches written before the failure are left out of the file
+					if err := p.writeSpill(spilled.Path, spilled.Tag, buf); err != nil {
+						p.Warnf("error updating spilled buffer %s: %v\n", spilled.Path, err)
+					}
+				}
+				return
+			}
+		}
+
+		if err := os.Remove(spilled.Path); err != nil {
+			p.Warnf("error removing spilled buffer %s: %v\n", spilled.Path, err)
+		}
+		p.Spilled = p.Spilled[1:]
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+type toggleClient struct {
+	*mockClient
+	fail bool
+}
+
+func (c *toggleClient) Write(bucket, object string, content io.Reader) error {
+	if c.fail {
+		return fmt.Errorf("service unavailable")
+	}
+	return c.mockClient.Write(bucket, object, content)
+}
+
+func TestSpillRetryBuffers(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.MaxInflightRetryBuffers = 1
+	ctx.SpillDir = t.TempDir()
+
+	tags := []string{"app.a", "app.b", "app.c"}
+	for _, tag := range tags {
+		if err := ctx.addRecord(tag, []byte(`{"tag":"`+tag+`"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushBuffer(ctx, tag); err == nil {
+			t.Fatalf("flushBuffer(%v) succeeded with a failing client", tag)
+		}
+	}
+
+	if len(ctx.Spilled) != 2 {
+		t.Fatalf("len(Spilled) = %v, want %v", len(ctx.Spilled), 2)
+	}
+	inMemory := 0
+	for _, buf := range ctx.Buffers {
+		if buf.Buffer.Len() > 0 {
+			inMemory++
+		}
+	}
+	if inMemory != 1 {
+		t.Errorf("retrying buffers in memory = %v, want %v", inMemory, 1)
+	}
+	for i, tag := range tags[:2] {
+		if ctx.Spilled[i].Tag != tag {
+			t.Errorf("Spilled[%d].Tag = %v, want oldest %v", i, ctx.Spilled[i].Tag, tag)
+		}
+	}
+
+	// retries continue from disk once the backend recovers
+	client.fail = false
+	if err := ctx.flushExpired(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Spilled) != 0 {
+		t.Errorf("len(Spilled) = %v, want %v", len(ctx.Spilled), 0)
+	}
+	if len(client.objects) != 3 {
+		t.Errorf("objects written = %v, want %v", len(client.objects), 3)
+	}
+	entries, err := os.ReadDir(ctx.SpillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("spill files left = %v, want %v", len(entries), 0)
+	}
+}
+
+func TestSpillKeepsRetryState(t *testing.T) {
+	spillDir := t.TempDir()
+	first := time.Date(2024, 4, 1, 10, 0, 30, 0, time.UTC)
+	retryingSince := time.Now().Add(-time.Hour)
+
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.SpillDir = spillDir
+	for i, ts := range []time.Time{first, first.Add(time.Minute)} {
+		if err := ctx.addRecord("app", []byte(fmt.Sprintf(`{"id":%d}`, i)), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushBuffer(ctx, "app")
+	ctx.Buffers["app"].RetryingSince = retryingSince
+	// the process exits while the buffer is retrying
+	ctx.spillRetrying()
+
+	// another destination never claims the file
+	other := newTestContext(newMockClient(), map[string]string{"bucket": "other", "prefix": "logs"})
+	other.SpillDir = spillDir
+	other.loadSpilled()
+	if len(other.Spilled) != 0 {
+		t.Errorf("len(Spilled) = %v for another bucket, want %v", len(other.Spilled), 0)
+	}
+
+	// the next process picks the file up with its event times
+	client.fail = false
+	next := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	next.SpillDir = spillDir
+	next.SubpartitionByEventTime = true
+	next.loadSpilled()
+	if len(next.Spilled) != 1 || next.Spilled[0].Tag != "app" {
+		t.Fatalf("Spilled = %v, want the buffer of app", next.Spilled)
+	}
+	header, _, err := readSpill(next.Spilled[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.RetryingSince.Equal(retryingSince) || len(header.Times) != 2 {
+		t.Errorf("header = %+v, want the retry start and both record times", header)
+	}
+	next.retrySpilled(time.Now())
+	if len(client.objects) != 2 {
+		t.Errorf("objects written = %v, want one per minute of event time", len(client.objects))
+	}
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("spill files left = %v, want %v", len(entries), 0)
+	}
+}
+
+func TestSpillMaxRetryDuration(t *testing.T) {
+	client := &prefixFailingClient{mockClient: newMockClient(), prefix: "logs/", err: fmt.Errorf("service unavailable")}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs", "deadLetterPrefix": "dlq"})
+	ctx.SpillDir = t.TempDir()
+	ctx.MaxInflightRetryBuffers = 1
+	ctx.MaxRetryDuration = time.Minute
+
+	for _, tag := range []string{"app.a", "app.b"} {
+		if err := ctx.addRecord(tag, []byte(`{"tag":"`+tag+`"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		flushBuffer(ctx, tag)
+	}
+	if len(ctx.Spilled) != 1 {
+		t.Fatalf("len(Spilled) = %v, want %v", len(ctx.Spilled), 1)
+	}
+
+	// rewrite the spilled buffer as retrying for longer than allowed
+	header, data, err := readSpill(ctx.Spilled[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &TagBuffer{Times: header.Times, RetryingSince: time.Now().Add(-time.Hour)}
+	buf.Buffer.Write(data)
+	if err := ctx.writeSpill(ctx.Spilled[0].Path, header.Tag, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.retrySpilled(time.Now().Add(time.Minute))
+	if len(ctx.Spilled) != 0 {
+		t.Errorf("len(Spilled) = %v, want the expired buffer given up on", len(ctx.Spilled))
+	}
+	if len(client.objects) != 1 {
+		t.Errorf("objects written = %v, want the dead letter of the expired buffer", len(client.objects))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PluginStatus is a snapshot of the buffer and retry state of a plugin instance
+type PluginStatus struct {
+	// BufferedBytes is the size of all tag buffers held in memory
+	BufferedBytes int `json:"buffered_bytes"`
+	// BufferUtilization is the fullest tag buffer as a percent of BufferSize
+	BufferUtilization float64 `json:"buffer_utilization"`
+	// Retries counts failed flushes since the last successful one
+	Retries int `json:"retries"`
+	// Retrying is set while any buffer is kept in memory or on disk for a retry
+	Retrying bool `json:"retrying"`
+	// LastFlush is when a buffer was last written successfully, zero if never
+	LastFlush time.Time `json:"last_flush"`
+	// LastError is the most recent flush error, empty if none
+	LastError string `json:"last_error"`
+	// SuccessCount and SuccessBytes count the objects written and their compressed size
+	SuccessCount int64 `json:"success_count"`
+	SuccessBytes int64 `json:"success_bytes"`
+	// FailedCount and FailedBytes count the failed object writes and the
+	// compressed bytes sent before they failed
+	FailedCount int64 `json:"failed_count"`
+	FailedBytes int64 `json:"failed_bytes"`
+	// LowCompressionEvents counts flushes compressing worse than Min_Compression_Ratio
+	LowCompressionEvents int64 `json:"low_compression_events"`
+	// OversizedRecords counts records dropped for exceeding Max_Record_Size_Bytes
+	OversizedRecords int64 `json:"oversized_records"`
+	// VerificationFailures counts objects failing the Read_After_Write check
+	VerificationFailures int64 `json:"verification_failures"`
+	// StuckFlushes counts writes caught by Watchdog_Timeout_Sec
+	StuckFlushes int64 `json:"stuck_flushes"`
+	// AbandonedWrites counts the writes given up on by Watchdog_Abort still running
+	AbandonedWrites int64 `json:"abandoned_writes"`
+}
+
+// Status : report the current buffer and retry state, for liveness probing.
+// Served as JSON under /healthz by the admin server. Takes mutex, so it
+// must not be called with it held.
+func (p *PluginContext) Status() PluginStatus {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	status := PluginStatus{
+		Retries:   p.Retries,
+		Retrying:  len(p.Spilled) > 0,
+		LastFlush: p.LastFlush,
+
+		SuccessCount: p.SuccessCount,
+		SuccessBytes: p.SuccessBytes,
+		FailedCount:  p.FailedCount,
+		FailedBytes:  p.FailedBytes,
+
+		LowCompressionEvents: p.LowCompressionEvents,
+		OversizedRecords:     p.OversizedRecords,
+		VerificationFailures: atomic.LoadInt64(&p.VerificationFailures),
+		StuckFlushes:         atomic.LoadInt64(&p.StuckFlushes),
+		AbandonedWrites:      atomic.LoadInt64(&p.AbandonedWrites),
+	}
+	if p.LastError != nil {
+		status.LastError = p.LastError.Error()
+	}
+
+	fullest := 0
+	for _, buf := range p.Buffers {
+		status.BufferedBytes += buf.CurrentBufferSize
+		if buf.CurrentBufferSize > fullest {
+			fullest = buf.CurrentBufferSize
+		}
+		if !buf.RetryingSince.IsZero() {
+			status.Retrying = true
+		}
+	}
+	if p.BufferSize > 0 {
+		status.BufferUtilization = float64(fullest) * 100 / float64(p.BufferSize)
+	}
+	return status
+}
+
+// recordFlush : update the status after flushing a buffer, err nil on success
+func (p *PluginContext) recordFlush(err error) {
+	if err != nil {
+		p.Retries++
+		p.LastError = err
+		return
+	}
+	p.Retries = 0
+	p.LastFlush = time.Now()
+}
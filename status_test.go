@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusRetrying(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.BufferSize = 100
+
+	if err := ctx.addRecord("app", []byte(`{"message":"hello"}`), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := flushBuffer(ctx, "app"); err == nil {
+			t.Fatal("flushBuffer succeeded with a failing client")
+		}
+	}
+
+	status := ctx.Status()
+	if !status.Retrying {
+		t.Errorf("Retrying = %v, want %v", status.Retrying, true)
+	}
+	if status.Retries != 2 {
+		t.Errorf("Retries = %v, want %v", status.Retries, 2)
+	}
+	if status.BufferedBytes != 20 {
+		t.Errorf("BufferedBytes = %v, want %v", status.BufferedBytes, 20)
+	}
+	if status.BufferUtilization != 20 {
+		t.Errorf("BufferUtilization = %v, want %v", status.BufferUtilization, 20)
+	}
+	if status.LastError != "service unavailable" {
+		t.Errorf("LastError = %q, want %q", status.LastError, "service unavailable")
+	}
+	if !status.LastFlush.IsZero() {
+		t.Errorf("LastFlush = %v, want zero", status.LastFlush)
+	}
+
+	client.fail = false
+	if err := flushBuffer(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	status = ctx.Status()
+	if status.Retrying || status.Retries != 0 || status.BufferedBytes != 0 {
+		t.Errorf("Status() = %+v, want healthy", status)
+	}
+	if status.LastFlush.IsZero() {
+		t.Error("LastFlush is zero after a successful flush")
+	}
+}
+
+func TestStatusWriteCounters(t *testing.T) {
+	client := &toggleClient{mockClient: newMockClient(), fail: true}
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+
+	for _, fail := range []bool{true, false, false} {
+		client.fail = fail
+		if err := ctx.addRecord("app", []byte(`{"message":"hello"}`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		flushBuffer(ctx, "app")
+	}
+
+	// the failed record is retried in an object of its own
+	status := ctx.Status()
+	if status.SuccessCount != 3 || status.FailedCount != 1 {
+		t.Errorf("SuccessCount, FailedCount = %v, %v, want %v, %v", status.SuccessCount, status.FailedCount, 3, 1)
+	}
+	var written int64
+	for _, data := range client.objects {
+		written += int64(len(data))
+	}
+	if status.SuccessBytes != written {
+		t.Errorf("SuccessBytes = %v, want the %v bytes written", status.SuccessBytes, written)
+	}
+	if status.FailedBytes != 0 {
+		t.Errorf("FailedBytes = %v, want %v for a write failing before reading", status.FailedBytes, 0)
+	}
+}
+
+func TestStatusStuckFlushes(t *testing.T) {
+	client := &hangingClient{release: make(chan struct{})}
+	defer close(client.release)
+	ctx := newTestContext(client, map[string]string{"bucket": "bucket", "prefix": "logs"})
+	ctx.WatchdogTimeout = 20 * time.Millisecond
+	ctx.WatchdogAbort = true
+
+	ctx.writeObject(ctx.destination("app"), "object", strings.NewReader("data"), WriteOptions{})
+	if got := ctx.Status().StuckFlushes; got != 1 {
+		t.Errorf("StuckFlushes = %v, want %v", got, 1)
+	}
+}
@@ -2,34 +2,189 @@ package main
 
 import (
 	"context"
+	"errors"
 	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
+// StorageClient is implemented by the backends objects are written to
+type StorageClient interface {
+	Write(bucket, object string, content io.Reader) error
+}
+
+// ObjectReader is implemented by backends able to read objects back
+type ObjectReader interface {
+	Read(bucket, object string) (io.ReadCloser, error)
+}
+
+// ObjectAppender is implemented by backends able to append an object to
+// another. Append returns the object member landed in, which differs from
+// object once it rolled over. opts are set on the appended object.
+type ObjectAppender interface {
+	Append(bucket, object, member string, opts WriteOptions) (string, error)
+}
+
+// ObjectDeleter is implemented by backends able to delete objects
+type ObjectDeleter interface {
+	Delete(bucket, object string) error
+}
+
+// BucketCreator is implemented by backends able to create missing buckets
+type BucketCreator interface {
+	BucketExists(bucket string) (bool, error)
+	CreateBucket(bucket, location string) error
+}
+
+// ObjectChecker is implemented by backends able to look up written objects
+type ObjectChecker interface {
+	Exists(bucket, object string) (exists bool, size int64, err error)
+}
+
+// ObjectCompactor is implemented by backends able to merge objects
+type ObjectCompactor interface {
+	ListObjects(bucket, prefix string) ([]ObjectInfo, error)
+	Compose(bucket, object string, sources []string, opts WriteOptions) error
+}
+
+// ObjectInfo describes a listed object
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	Created time.Time
+	// Metadata and StorageClass are the attributes the object was written with
+	Metadata     map[string]string
+	StorageClass string
+}
+
+// WriteOptions are per-object attributes set on a write
+type WriteOptions struct {
+	// Metadata is the custom metadata of the object
+	Metadata map[string]string
+	// StorageClass overrides the bucket default storage class when set
+	StorageClass string
+}
+
+func (o WriteOptions) empty() bool {
+	return o.Metadata == nil && o.StorageClass == ""
+}
+
+// OptionsWriter is implemented by backends able to set per-object attributes
+type OptionsWriter interface {
+	WriteWithOptions(bucket, object string, content io.Reader, opts WriteOptions) error
+}
+
 // Client & Context Google Cloud
 type Client struct {
 	CTX context.Context
 	GCS *storage.Client
+
+	// ContentType is set on every written object
+	ContentType string
+	// GzipContentEncoding marks objects with Content-Encoding: gzip so
+	// consumers that honor it decompress transparently
+	GzipContentEncoding bool
+	// ChunkSize is the resumable upload chunk size, 0 uploads in a single request
+	ChunkSize int
+	// PredefinedACL is applied to every written object, empty keeps the bucket default
+	PredefinedACL string
+	// ProjectID owns the buckets created by CreateBucket
+	ProjectID string
+	// MaxObjectBytes rolls objects Append grows over to their numbered
+	// parts once they reach this size, 0 for no limit
+	MaxObjectBytes int64
+	// Log writes the messages of the plugin instance, nil logs them all
+	Log *Logger
 }
 
-// NewClient Google Cloud
-func NewClient() (Client, error) {
+// storageClasses are the storage class names accepted by GCS object writes
+var storageClasses = map[string]bool{
+	"STANDARD":                     true,
+	"NEARLINE":                     true,
+	"COLDLINE":                     true,
+	"ARCHIVE":                      true,
+	"MULTI_REGIONAL":               true,
+	"REGIONAL":                     true,
+	"DURABLE_REDUCED_AVAILABILITY": true,
+}
+
+// predefinedACLs are the predefined ACL names accepted by GCS object writes
+var predefinedACLs = map[string]bool{
+	"authenticatedRead":      true,
+	"bucketOwnerFullControl": true,
+	"bucketOwnerRead":        true,
+	"private":                true,
+	"projectPrivate":         true,
+	"publicRead":             true,
+}
+
+// newStorageClient builds the GCS client, replaced in tests
+var newStorageClient = storage.NewClient
+
+// NewClient Google Cloud. credential is a key file path or a gcp-secret://
+// Secret Manager reference. Without one, Application Default Credentials
+// are used (metadata server, GKE Workload Identity, ...).
+// endpoint overrides the GCS API endpoint and noAuth sends unauthenticated
+// requests, both meant for emulators such as fake-gcs-server.
+func NewClient(credential, endpoint string, noAuth bool) (Client, error) {
+	var opts []option.ClientOption
+	switch {
+	case noAuth:
+		opts = append(opts, option.WithoutAuthentication())
+	case credential != "":
+		if name, ok := secretName(credential); ok {
+			json, err := fetchSecret(name)
+			if err != nil {
+				return Client{}, err
+			}
+			opts = append(opts, option.WithCredentialsJSON(json))
+			break
+		}
+		opts = append(opts, option.WithCredentialsFile(credential))
+	default:
+		log.Printf("[info] No credential file set, using Application Default Credentials\n")
+	}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	client, err := newStorageClient(ctx, opts...)
 	if err != nil {
 		return Client{}, err
 	}
 
 	return Client{
-		CTX: ctx,
-		GCS: client,
+		CTX:                 ctx,
+		GCS:                 client,
+		ContentType:         "application/json",
+		GzipContentEncoding: true,
+		ChunkSize:           googleapi.DefaultUploadChunkSize,
 	}, nil
 }
 
 // Write content in object GCS
 func (c Client) Write(bucket, object string, content io.Reader) error {
-	wc := c.GCS.Bucket(bucket).Object(object).NewWriter(c.CTX)
+	return c.WriteWithOptions(bucket, object, content, WriteOptions{})
+}
+
+// WriteWithOptions writes content in object GCS with per-object attributes
+func (c Client) WriteWithOptions(bucket, object string, content io.Reader, opts WriteOptions) error {
+	// cancelling the context aborts a partial resumable upload
+	ctx, cancel := context.WithCancel(c.CTX)
+	defer cancel()
+
+	wc := c.GCS.Bucket(bucket).Object(object).NewWriter(ctx)
+	c.configureWriter(wc)
+	wc.Metadata = opts.Metadata
+	wc.StorageClass = opts.StorageClass
 	if _, err := io.Copy(wc, content); err != nil {
 		return err
 	}
@@ -40,3 +195,228 @@ func (c Client) Write(bucket, object string, content io.Reader) error {
 
 	return nil
 }
+
+// Delete removes object from bucket
+func (c Client) Delete(bucket, object string) error {
+	return c.GCS.Bucket(bucket).Object(object).Delete(c.CTX)
+}
+
+// Close the GCS client
+func (c Client) Close() error {
+	return c.GCS.Close()
+}
+
+// Append composes object from its current content followed by member,
+// creating it from member alone when it doesn't exist, then deletes member.
+// An object with maxComponentCount components or MaxObjectBytes rolls over
+// to its numbered parts. The metadata of opts is merged into the metadata
+// of an existing object. Concurrent appends to the same object may lose one of the members.
+func (c Client) Append(bucket, object, member string, opts WriteOptions) (string, error) {
+	bkt := c.GCS.Bucket(bucket)
+	src := bkt.Object(member)
+
+	// existing holds the attributes of the last object looked up, the target
+	var existing *storage.ObjectAttrs
+	target, exists, err := appendTarget(object, c.MaxObjectBytes, func(name string) (int64, int64, bool, error) {
+		attrs, err := bkt.Object(name).Attrs(c.CTX)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return 0, 0, false, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		existing = attrs
+		return attrs.ComponentCount, attrs.Size, true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	dst := bkt.Object(target)
+	sources := []*storage.ObjectHandle{src}
+	if exists {
+		sources = []*storage.ObjectHandle{dst, src}
+		opts.Metadata = mergeMetadata(existing.Metadata, opts.Metadata)
+	}
+	if _, err := c.composer(dst, opts, sources...).Run(c.CTX); err != nil {
+		return "", err
+	}
+
+	if err := src.Delete(c.CTX); err != nil {
+		c.Log.Warnf("error deleting appended member %s: %v\n", member, err)
+	}
+	return target, nil
+}
+
+// maxComponentCount is the most components GCS allows in a composite object
+const maxComponentCount = 1024
+
+// defaultMaxObjectBytes keeps appended objects well under the 5TB GCS limit
+const defaultMaxObjectBytes = 1024 * 1024 * 1024 * 1024
+
+// appendTarget : the first of object and its numbered parts with room for
+// one more component and under maxBytes, and whether it exists. attrs looks
+// up the component count and size of an object, false when it doesn't exist.
+func appendTarget(object string, maxBytes int64, attrs func(name string) (int64, int64, bool, error)) (string, bool, error) {
+	for part := 0; ; part++ {
+		name := object
+		if part > 0 {
+			name = partObjectKey(object, part-1)
+		}
+		count, size, exists, err := attrs(name)
+		if err != nil {
+			return "", false, err
+		}
+		// objects that were never composed count as a single component
+		if !exists || (count < maxComponentCount && (maxBytes <= 0 || size < maxBytes)) {
+			return name, exists, nil
+		}
+	}
+}
+
+// maxComposeSources is the most objects GCS composes in a single request
+const maxComposeSources = 32
+
+// Compose merges sources, in order, into object then deletes them, setting
+// opts on object. More than maxComposeSources sources are composed in
+// several requests.
+func (c Client) Compose(bucket, object string, sources []string, opts WriteOptions) error {
+	bkt := c.GCS.Bucket(bucket)
+	dst := bkt.Object(object)
+
+	var handles []*storage.ObjectHandle
+	for i, source := range sources {
+		handles = append(handles, bkt.Object(source))
+		if len(handles) < maxComposeSources && i < len(sources)-1 {
+			continue
+		}
+		if _, err := c.composer(dst, opts, handles...).Run(c.CTX); err != nil {
+			return err
+		}
+		// later requests append to what was composed so far
+		handles = []*storage.ObjectHandle{dst}
+	}
+
+	for _, source := range sources {
+		if err := bkt.Object(source).Delete(c.CTX); err != nil {
+			c.Log.Warnf("error deleting compacted object %s: %v\n", source, err)
+		}
+	}
+	return nil
+}
+
+// ListObjects lists the objects of bucket whose name starts with prefix
+func (c Client) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	it := c.GCS.Bucket(bucket).Objects(c.CTX, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, ObjectInfo{
+			Name:         attrs.Name,
+			Size:         attrs.Size,
+			Created:      attrs.Created,
+			Metadata:     attrs.Metadata,
+			StorageClass: attrs.StorageClass,
+		})
+	}
+}
+
+// composer : a composer of sources into dst, setting the attributes of
+// written objects and opts, as configureWriter does for writes
+func (c Client) composer(dst *storage.ObjectHandle, opts WriteOptions, sources ...*storage.ObjectHandle) *storage.Composer {
+	composer := dst.ComposerFrom(sources...)
+	composer.ContentType = c.ContentType
+	if c.GzipContentEncoding {
+		composer.ContentEncoding = "gzip"
+	}
+	composer.PredefinedACL = c.PredefinedACL
+	composer.Metadata = opts.Metadata
+	composer.StorageClass = opts.StorageClass
+	return composer
+}
+
+// BucketExists reports whether bucket exists in GCS
+func (c Client) BucketExists(bucket string) (bool, error) {
+	_, err := c.GCS.Bucket(bucket).Attrs(c.CTX)
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Exists reports whether object exists in GCS and its stored size
+func (c Client) Exists(bucket, object string) (bool, int64, error) {
+	attrs, err := c.GCS.Bucket(bucket).Object(object).Attrs(c.CTX)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, attrs.Size, nil
+}
+
+// CreateBucket creates bucket in GCS at location, a region or multi-region
+func (c Client) CreateBucket(bucket, location string) error {
+	return c.GCS.Bucket(bucket).Create(c.CTX, c.ProjectID, &storage.BucketAttrs{Location: location})
+}
+
+// Read opens an object of GCS, returning its stored bytes without
+// decompressive transcoding
+func (c Client) Read(bucket, object string) (io.ReadCloser, error) {
+	return c.GCS.Bucket(bucket).Object(object).ReadCompressed(true).NewReader(c.CTX)
+}
+
+// configureWriter applies upload settings and object metadata to a new writer
+func (c Client) configureWriter(wc *storage.Writer) {
+	wc.ChunkSize = c.ChunkSize
+	wc.ContentType = c.ContentType
+	if c.GzipContentEncoding {
+		wc.ContentEncoding = "gzip"
+	}
+	wc.PredefinedACL = c.PredefinedACL
+}
+
+// isRetryable reports whether a failed write may succeed when tried again.
+// Client errors from GCS such as a missing bucket or a permission denied
+// are permanent, everything else is assumed transient.
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+
+	switch {
+	case apiErr.Code == http.StatusRequestTimeout, apiErr.Code == http.StatusTooManyRequests:
+		return true
+	case apiErr.Code >= 400 && apiErr.Code < 500:
+		return false
+	}
+	return true
+}
+
+// retryAfter : the delay a rate limited request asked for through its
+// Retry-After header, 0 when there is none
+func retryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests {
+		return 0
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
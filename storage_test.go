@@ -0,0 +1,403 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestConfigureWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   Client
+		encoding string
+	}{
+		{"gzip encoding", Client{ContentType: "application/json", GzipContentEncoding: true, ChunkSize: 8 * 1024 * 1024}, "gzip"},
+		{"served as-is", Client{ContentType: "application/json", GzipContentEncoding: false, ChunkSize: 0}, ""},
+		{"predefined acl", Client{ContentType: "application/json", GzipContentEncoding: true, PredefinedACL: "publicRead"}, "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wc := &storage.Writer{}
+			tt.client.configureWriter(wc)
+
+			if wc.ContentType != "application/json" {
+				t.Errorf("ContentType = %v, want %v", wc.ContentType, "application/json")
+			}
+			if wc.ContentEncoding != tt.encoding {
+				t.Errorf("ContentEncoding = %v, want %v", wc.ContentEncoding, tt.encoding)
+			}
+			if wc.ChunkSize != tt.client.ChunkSize {
+				t.Errorf("ChunkSize = %v, want %v", wc.ChunkSize, tt.client.ChunkSize)
+			}
+			if wc.PredefinedACL != tt.client.PredefinedACL {
+				t.Errorf("PredefinedACL = %v, want %v", wc.PredefinedACL, tt.client.PredefinedACL)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 408}, true},
+		{&googleapi.Error{Code: 403}, false},
+		{fmt.Errorf("write: %w", &googleapi.Error{Code: 404}), false},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewClientCredentials(t *testing.T) {
+	defer func(original func(context.Context, ...option.ClientOption) (*storage.Client, error)) {
+		newStorageClient = original
+	}(newStorageClient)
+
+	var got []option.ClientOption
+	newStorageClient = func(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+		got = opts
+		return &storage.Client{}, nil
+	}
+
+	if _, err := NewClient("", "", false); err != nil {
+		t.Fatalf("NewClient(\"\") = %v, want application default credentials", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("NewClient(\"\") passed %d options, want none", len(got))
+	}
+
+	if _, err := NewClient("/secure/google.json", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("NewClient(path) passed %d options, want a credentials file", len(got))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	rateLimited := func(value string) error {
+		header := http.Header{}
+		header.Set("Retry-After", value)
+		return &googleapi.Error{Code: http.StatusTooManyRequests, Header: header}
+	}
+
+	if got := retryAfter(rateLimited("30")); got < 30*time.Second {
+		t.Errorf("retryAfter(30) = %v, want at least %v", got, 30*time.Second)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := retryAfter(rateLimited(date)); got < 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(%v) = %v, want about %v", date, got, time.Minute)
+	}
+	for _, err := range []error{
+		rateLimited(""),
+		rateLimited("soon"),
+		&googleapi.Error{Code: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"30"}}},
+		fmt.Errorf("connection reset"),
+	} {
+		if got := retryAfter(err); got != 0 {
+			t.Errorf("retryAfter(%v) = %v, want 0", err, got)
+		}
+	}
+}
+
+func TestNewClientEndpoint(t *testing.T) {
+	var uploads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("request sent with Authorization header, want none")
+		}
+		uploads = append(uploads, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("name"))
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"bucket":"bucket","name":"logs/app.log.gz"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient("/secure/google.json", server.URL+"/storage/v1/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.ChunkSize = 0
+
+	if err := client.Write("bucket", "logs/app.log.gz", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /upload/storage/v1/b/bucket/o logs/app.log.gz"
+	if len(uploads) != 1 || uploads[0] != want {
+		t.Errorf("requests = %v, want [%v]", uploads, want)
+	}
+}
+
+func TestNewClientSecretCredential(t *testing.T) {
+	defer func(original func(context.Context, ...option.ClientOption) (*storage.Client, error)) {
+		newStorageClient = original
+	}(newStorageClient)
+	defer func(original func(string) ([]byte, error)) {
+		fetchSecret = original
+	}(fetchSecret)
+
+	key := []byte(`{"type":"service_account"}`)
+	var fetched string
+	fetchSecret = func(name string) ([]byte, error) {
+		fetched = name
+		return key, nil
+	}
+	var got []option.ClientOption
+	newStorageClient = func(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+		got = opts
+		return &storage.Client{}, nil
+	}
+
+	if _, err := NewClient("gcp-secret://projects/x/secrets/y/versions/latest", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if want := "projects/x/secrets/y/versions/latest"; fetched != want {
+		t.Errorf("fetched secret = %v, want %v", fetched, want)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], option.WithCredentialsJSON(key)) {
+		t.Errorf("NewClient(secret) options = %v, want the fetched credentials JSON", got)
+	}
+
+	fetchSecret = func(name string) ([]byte, error) {
+		return nil, errors.New("permission denied")
+	}
+	if _, err := NewClient("gcp-secret://projects/x/secrets/y/versions/latest", "", false); err == nil {
+		t.Error("NewClient() = nil with an unreadable secret, want an error")
+	}
+}
+
+func TestExists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/o/logs/app.log.gz") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Not Found"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"bucket":"bucket","name":"logs/app.log.gz","size":"42"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient("", server.URL+"/storage/v1/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mock := newMockClient()
+	if err := mock.Write("bucket", "logs/app.log.gz", strings.NewReader(strings.Repeat("x", 42))); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, checker := range map[string]ObjectChecker{"gcs": client, "mock": mock} {
+		exists, size, err := checker.Exists("bucket", "logs/app.log.gz")
+		if err != nil || !exists || size != 42 {
+			t.Errorf("%s Exists(present) = %v, %v, %v, want true, 42, nil", name, exists, size, err)
+		}
+		exists, size, err = checker.Exists("bucket", "logs/missing.log.gz")
+		if err != nil || exists || size != 0 {
+			t.Errorf("%s Exists(absent) = %v, %v, %v, want false, 0, nil", name, exists, size, err)
+		}
+	}
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	var stored []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			mr.NextPart()
+			part, _ := mr.NextPart()
+			stored, _ = io.ReadAll(part)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"bucket":"bucket","name":"logs/app.log.gz"}`)
+			return
+		}
+		w.Write(stored)
+	}))
+	defer server.Close()
+
+	client, err := NewClient("", server.URL+"/storage/v1/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.ChunkSize = 0
+
+	want := "{\"msg\":\"a\"}\n"
+	for name, backend := range map[string]interface {
+		StorageClient
+		ObjectReader
+	}{"gcs": client, "mock": newMockClient()} {
+		compressed, err := compress([]byte(want), gzip.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Write("bucket", "logs/app.log.gz", compressed); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := backend.Read("bucket", "logs/app.log.gz")
+		if err != nil {
+			t.Fatalf("%s Read() = %v", name, err)
+		}
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			t.Fatalf("%s Read() returned non-gzip content: %v", name, err)
+		}
+		got, err := io.ReadAll(zr)
+		rc.Close()
+		if err != nil || string(got) != want {
+			t.Errorf("%s Read() = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestAppendRollsOverComponentCap(t *testing.T) {
+	var composed, deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/compose"):
+			var req struct {
+				SourceObjects []struct{ Name string } `json:"sourceObjects"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			composed = append(composed, r.URL.Path)
+			for _, source := range req.SourceObjects {
+				composed = append(composed, source.Name)
+			}
+			fmt.Fprint(w, `{"bucket":"bucket","name":"composed"}`)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/o/logs/10.log.gz"):
+			fmt.Fprintf(w, `{"bucket":"bucket","name":"logs/10.log.gz","componentCount":%d}`, maxComponentCount)
+		case strings.HasSuffix(r.URL.Path, "/o/logs/10_part0001.log.gz"):
+			fmt.Fprint(w, `{"bucket":"bucket","name":"logs/10_part0001.log.gz","componentCount":7}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Not Found"}}`)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient("", server.URL+"/storage/v1/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	target, err := client.Append("bucket", "logs/10.log.gz", "logs/10.log.gz.member_1", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "logs/10_part0001.log.gz"; target != want {
+		t.Errorf("Append() = %v, want %v", target, want)
+	}
+	want := []string{"/storage/v1/b/bucket/o/logs/10_part0001.log.gz/compose", "logs/10_part0001.log.gz", "logs/10.log.gz.member_1"}
+	if !reflect.DeepEqual(composed, want) {
+		t.Errorf("composed = %v, want %v", composed, want)
+	}
+	if len(deleted) != 1 || !strings.HasSuffix(deleted[0], "/o/logs/10.log.gz.member_1") {
+		t.Errorf("deleted = %v, want the member", deleted)
+	}
+}
+
+func TestComposeKeepsWriteOptions(t *testing.T) {
+	type composeRequest struct {
+		Destination struct {
+			Metadata     map[string]string `json:"metadata"`
+			StorageClass string            `json:"storageClass"`
+		} `json:"destination"`
+		PredefinedACL string
+	}
+	var requests []composeRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/compose"):
+			var req composeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			req.PredefinedACL = r.URL.Query().Get("destinationPredefinedAcl")
+			requests = append(requests, req)
+			fmt.Fprint(w, `{"bucket":"bucket","name":"composed"}`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/o/logs/10.log.gz"):
+			fmt.Fprint(w, `{"bucket":"bucket","name":"logs/10.log.gz","componentCount":2,`+
+				`"metadata":{"min-timestamp":"2024-04-01T10:00:00Z","max-timestamp":"2024-04-01T10:10:00Z","owner":"team"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Not Found"}}`)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient("", server.URL+"/storage/v1/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.PredefinedACL = "bucketOwnerRead"
+
+	opts := WriteOptions{
+		StorageClass: "NEARLINE",
+		Metadata: map[string]string{
+			"min-timestamp": "2024-04-01T10:20:00Z",
+			"max-timestamp": "2024-04-01T10:30:00Z",
+		},
+	}
+	if _, err := client.Append("bucket", "logs/10.log.gz", "logs/10.log.gz.member_1", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Compose("bucket", "logs/compacted.log.gz", []string{"logs/a.log.gz", "logs/b.log.gz"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("compose requests = %v, want %v", len(requests), 2)
+	}
+
+	// the appended object keeps its own metadata and the oldest timestamp
+	wantMetadata := []map[string]string{
+		{"min-timestamp": "2024-04-01T10:00:00Z", "max-timestamp": "2024-04-01T10:30:00Z", "owner": "team"},
+		opts.Metadata,
+	}
+	for i, req := range requests {
+		if !reflect.DeepEqual(req.Destination.Metadata, wantMetadata[i]) {
+			t.Errorf("composed metadata = %v, want %v", req.Destination.Metadata, wantMetadata[i])
+		}
+		if req.Destination.StorageClass != opts.StorageClass {
+			t.Errorf("composed storage class = %q, want %q", req.Destination.StorageClass, opts.StorageClass)
+		}
+		if req.PredefinedACL != client.PredefinedACL {
+			t.Errorf("composed predefined ACL = %q, want %q", req.PredefinedACL, client.PredefinedACL)
+		}
+	}
+}